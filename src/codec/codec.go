@@ -0,0 +1,168 @@
+// Package codec implements the compression codecs of zar images, looked up by the
+// name recorded in the image
+package codec
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Codec compresses and decompresses blocks of data
+type Codec interface {
+	// Compress returns the compressed form of src
+	Compress(src []byte) ([]byte, error)
+
+	// Decompress decompresses src into dst, which has the size of the original data
+	Decompress(dst []byte, src []byte) error
+}
+
+// Bounded is implemented by codecs whose data expands at most by a known ratio
+// when decompressed, so readers can reject sizes a corrupt image claims
+type Bounded interface {
+	// MaxRatio returns the largest ratio of decompressed to compressed size
+	MaxRatio() int64
+}
+
+// deflateRatio is the largest expansion of DEFLATE: a block of matches of the
+// maximum length of 258 bytes takes just over 2 bits per match
+const deflateRatio = 1032
+
+// codecs are the registered codecs by name
+var codecs = map[string]Codec{
+	"flate": Flate{Level: flate.DefaultCompression},
+	"gzip":  Gzip{Level: gzip.DefaultCompression},
+}
+
+// Register makes a codec available by name, replacing any codec of that name
+func Register(name string, c Codec) {
+	codecs[name] = c
+}
+
+// Get returns the codec registered as name
+func Get(name string) (Codec, error) {
+	c, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %q", name)
+	}
+	return c, nil
+}
+
+// Names returns the names of the registered codecs in order
+func Names() []string {
+	var names []string
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// compressedMagics are the magic numbers of formats whose data is compressed already
+var compressedMagics = [][]byte{
+	{0x1f, 0x8b},                       // gzip
+	{0x28, 0xb5, 0x2f, 0xfd},           // zstd
+	{0xfd, '7', 'z', 'X', 'Z', 0x00},   // xz
+	{'B', 'Z', 'h'},                    // bzip2
+	{'P', 'K', 0x03, 0x04},             // zip, jar
+	{0x89, 'P', 'N', 'G'},              // png
+	{0xff, 0xd8, 0xff},                 // jpeg
+	{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}, // 7z
+}
+
+// IsCompressed returns whether data starting with head is in a compressed format,
+// so compressing it again is not worth it
+func IsCompressed(head []byte) bool {
+	for _, m := range compressedMagics {
+		if bytes.HasPrefix(head, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// Flate is the DEFLATE codec (RFC 1951)
+type Flate struct {
+	// Level is the compression level, see compress/flate
+	Level int
+}
+
+// Compress implements Codec.Compress
+func (f Flate) Compress(src []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w, err := flate.NewWriter(&b, f.Level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Decompress implements Codec.Decompress
+func (f Flate) Decompress(dst []byte, src []byte) error {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return readExactly(r, dst)
+}
+
+// MaxRatio implements Bounded.MaxRatio
+func (f Flate) MaxRatio() int64 {
+	return deflateRatio
+}
+
+// Gzip is the gzip codec (RFC 1952)
+type Gzip struct {
+	// Level is the compression level, see compress/gzip
+	Level int
+}
+
+// Compress implements Codec.Compress
+func (g Gzip) Compress(src []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w, err := gzip.NewWriterLevel(&b, g.Level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Decompress implements Codec.Decompress
+func (g Gzip) Decompress(dst []byte, src []byte) error {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return readExactly(r, dst)
+}
+
+// MaxRatio implements Bounded.MaxRatio. The header and trailer only lower the
+// ratio of the DEFLATE stream inside.
+func (g Gzip) MaxRatio() int64 {
+	return deflateRatio
+}
+
+// readExactly fills dst from r and checks that r has no more data
+func readExactly(r io.Reader, dst []byte) error {
+	if _, err := io.ReadFull(r, dst); err != nil {
+		return fmt.Errorf("decompressed data is shorter than %v bytes: %v", len(dst), err)
+	}
+	if n, _ := r.Read(make([]byte, 1)); n > 0 {
+		return fmt.Errorf("decompressed data is longer than %v bytes", len(dst))
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package codec_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"codec"
+)
+
+func TestCodecs(t *testing.T) {
+	data := []byte(strings.Repeat("apples and bananas\n", 100))
+	for _, name := range codec.Names() {
+		c, err := codec.Get(name)
+		if err != nil {
+			t.Fatalf("codec.Get(%v) failed: %v", name, err)
+		}
+		compressed, err := c.Compress(data)
+		if err != nil {
+			t.Fatalf("%v: Compress failed: %v", name, err)
+		}
+		if len(compressed) >= len(data) {
+			t.Errorf("%v: compressed %v bytes to %v", name, len(data), len(compressed))
+		}
+
+		out := make([]byte, len(data))
+		if err := c.Decompress(out, compressed); err != nil || !bytes.Equal(out, data) {
+			t.Errorf("%v: Decompress = %q, %v, expected the original data", name, out, err)
+		}
+		if err := c.Decompress(make([]byte, len(data)+1), compressed); err == nil {
+			t.Errorf("%v: Decompress into a larger buffer succeeded", name)
+		}
+		if err := c.Decompress(make([]byte, len(data)-1), compressed); err == nil {
+			t.Errorf("%v: Decompress into a smaller buffer succeeded", name)
+		}
+	}
+
+	if _, err := codec.Get("lzma"); err == nil {
+		t.Errorf("codec.Get(lzma) succeeded")
+	}
+}
+
+func TestMaxRatio(t *testing.T) {
+	// Zeros compress best
+	data := make([]byte, 16<<20)
+	for _, name := range codec.Names() {
+		c, _ := codec.Get(name)
+		b, ok := c.(codec.Bounded)
+		if !ok {
+			continue
+		}
+		compressed, err := c.Compress(data)
+		if err != nil {
+			t.Fatalf("%v: Compress failed: %v", name, err)
+		}
+		if int64(len(data)) > int64(len(compressed))*b.MaxRatio() {
+			t.Errorf("%v: compressed %v bytes to %v, more than the ratio %v", name, len(data), len(compressed), b.MaxRatio())
+		}
+	}
+}
+
+func TestIsCompressed(t *testing.T) {
+	if !codec.IsCompressed([]byte("\x1f\x8b\x08rest")) || !codec.IsCompressed([]byte("PK\x03\x04")) {
+		t.Errorf("IsCompressed of gzip or zip data returned false")
+	}
+	if codec.IsCompressed([]byte("plain text")) || codec.IsCompressed(nil) {
+		t.Errorf("IsCompressed of plain data returned true")
+	}
+}
@@ -0,0 +1,133 @@
+package reader
+
+import (
+	"fmt"
+	"io"
+
+	"codec"
+	"manager"
+)
+
+// checkChunks returns an error if the chunk table of the compressed file m does
+// not describe its stored data of the given size, or if the data can't
+// decompress to the size recorded. Callers check before they compute chunk
+// positions or allocate for the decompressed data.
+func checkChunks(m *manager.FileMetadata, size int64) error {
+	c, err := codec.Get(m.Codec)
+	if err != nil {
+		return err
+	}
+	if m.ChunkSize <= 0 || m.RawSize < 0 || m.RawSize > maxDecompressed(c, size) {
+		return fmt.Errorf("compressed size %v in chunks of %v is invalid for %v stored bytes", m.RawSize, m.ChunkSize, size)
+	}
+	n := m.RawSize / m.ChunkSize
+	if m.RawSize%m.ChunkSize != 0 {
+		n++
+	}
+	if int64(len(m.Chunks)) != n {
+		return fmt.Errorf("%v chunks of %v bytes for %v bytes, expected %v", len(m.Chunks), m.ChunkSize, m.RawSize, n)
+	}
+	prev := int64(0)
+	for _, end := range m.Chunks {
+		if end < prev {
+			return fmt.Errorf("chunk table %v is not sorted", m.Chunks)
+		}
+		prev = end
+	}
+	if prev != size {
+		return fmt.Errorf("chunks end at %v, the compressed data at %v", prev, size)
+	}
+	return nil
+}
+
+// decompress decompresses the chunks first up to (excluding) last of the compressed
+// file m, whose stored data is stored, into dst. The chunk table is checked
+// already, see checkChunks.
+func (img *Image) decompress(m *manager.FileMetadata, stored []byte, first int, last int, dst []byte) error {
+	c, err := codec.Get(m.Codec)
+	if err != nil {
+		return err
+	}
+
+	for k := first; k < last; k++ {
+		begin := int64(0)
+		if k > 0 {
+			begin = m.Chunks[k-1]
+		}
+		raw := m.ChunkSize
+		if rest := m.RawSize - int64(k)*m.ChunkSize; rest < raw {
+			raw = rest
+		}
+		if err := c.Decompress(dst[:raw], stored[begin:m.Chunks[k]]); err != nil {
+			return fmt.Errorf("%v: chunk %v: %v", m.Name, k, err)
+		}
+		dst = dst[raw:]
+	}
+	return nil
+}
+
+// ReadAt reads len(p) bytes of the data of the regular file m from offset off, as
+// io.ReaderAt. Of a compressed file only the chunks holding the bytes are
+// decompressed.
+func (img *Image) ReadAt(m *manager.FileMetadata, p []byte, off int64) (int, error) {
+	stored, err := img.stored(m)
+	if err != nil {
+		return 0, err
+	}
+	if m.Codec != "" {
+		if err := checkChunks(m, int64(len(stored))); err != nil {
+			return 0, fmt.Errorf("%v: %v", m.Name, err)
+		}
+	}
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %v", off)
+	}
+
+	size := m.Size()
+	if off >= size {
+		return 0, io.EOF
+	}
+	n := len(p)
+	if rest := size - off; int64(n) > rest {
+		n = int(rest)
+	}
+
+	if m.Codec == "" {
+		copy(p, stored[off:off+int64(n)])
+	} else {
+		first := int(off / m.ChunkSize)
+		last := int((off + int64(n) + m.ChunkSize - 1) / m.ChunkSize)
+		// The last chunk of the file may be short
+		end := m.RawSize
+		if last < len(m.Chunks) {
+			end = int64(last) * m.ChunkSize
+		}
+		buf := make([]byte, end-int64(first)*m.ChunkSize)
+		if err := img.decompress(m, stored, first, last, buf); err != nil {
+			return 0, err
+		}
+		copy(p, buf[off-int64(first)*m.ChunkSize:])
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// fileReader reads the data of a regular file of an image
+type fileReader struct {
+	img *Image
+	m   *manager.FileMetadata
+}
+
+// ReadAt implements io.ReaderAt.ReadAt
+func (r fileReader) ReadAt(p []byte, off int64) (int, error) {
+	return r.img.ReadAt(r.m, p, off)
+}
+
+// NewReader returns a reader of the data of the regular file m, which reads
+// compressed files chunk by chunk
+func (img *Image) NewReader(m *manager.FileMetadata) *io.SectionReader {
+	return io.NewSectionReader(fileReader{img, m}, 0, m.Size())
+}
@@ -0,0 +1,110 @@
+package reader
+
+import (
+	"bytes"
+	"sort"
+
+	"manager"
+)
+
+const (
+	// Kinds of changes reported by Diff
+	Added    = "added"
+	Removed  = "removed"
+	Modified = "modified"
+)
+
+// Change is a difference between two images found by Diff
+type Change struct {
+	// Path is the full path of the changed entry
+	Path string `json:"path"`
+
+	// Kind is one of Added, Removed or Modified
+	Kind string `json:"kind"`
+
+	// Fields lists what changed for a modified entry: "type", "content", "mode", "mtime" or "link"
+	Fields []string `json:"fields,omitempty"`
+}
+
+// DiffOptions controls what Diff compares
+type DiffOptions struct {
+	// IgnoreModTime skips the comparison of modification times, e.g. for rebuilt images
+	IgnoreModTime bool
+}
+
+// Diff compares the entries of two images by full path and returns the changes
+// needed to get from a to b, sorted by path.
+func Diff(a *Image, b *Image, opts DiffOptions) []Change {
+	before := make(map[string]*Entry)
+	for i, e := range a.Entries() {
+		before[e.Path] = &a.Entries()[i]
+	}
+	after := make(map[string]*Entry)
+	for i, e := range b.Entries() {
+		after[e.Path] = &b.Entries()[i]
+	}
+
+	var changes []Change
+	for p, ea := range before {
+		eb, ok := after[p]
+		if !ok {
+			changes = append(changes, Change{Path: p, Kind: Removed})
+			continue
+		}
+		if fields := diffEntry(a, ea, b, eb, opts); len(fields) > 0 {
+			changes = append(changes, Change{Path: p, Kind: Modified, Fields: fields})
+		}
+	}
+	for p := range after {
+		if _, ok := before[p]; !ok {
+			changes = append(changes, Change{Path: p, Kind: Added})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+
+	return changes
+}
+
+// diffEntry returns the fields that differ between the entry ea of a and eb of b
+func diffEntry(a *Image, ea *Entry, b *Image, eb *Entry, opts DiffOptions) []string {
+	if ea.Type != eb.Type {
+		return []string{"type"}
+	}
+
+	var fields []string
+	if ea.Type == manager.RegularFile && !sameContent(a, ea, b, eb) {
+		fields = append(fields, "content")
+	}
+	if ea.Mode != eb.Mode {
+		fields = append(fields, "mode")
+	}
+	if !opts.IgnoreModTime && ea.ModTime != eb.ModTime {
+		fields = append(fields, "mtime")
+	}
+	if ea.Link != eb.Link {
+		fields = append(fields, "link")
+	}
+
+	return fields
+}
+
+// sameContent compares the content of two regular files. Stored checksums are
+// used when both files have one, otherwise the data is compared byte by byte.
+func sameContent(a *Image, ea *Entry, b *Image, eb *Entry) bool {
+	if ea.Size() != eb.Size() {
+		return false
+	}
+	if ea.Checksum != "" && eb.Checksum != "" {
+		return ea.Checksum == eb.Checksum
+	}
+
+	ca, erra := a.Content(&ea.FileMetadata)
+	cb, errb := b.Content(&eb.FileMetadata)
+	if erra != nil || errb != nil {
+		return false
+	}
+	return bytes.Equal(ca, cb)
+}
@@ -0,0 +1,52 @@
+package reader_test
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"fileio/reader"
+)
+
+func TestDiff(t *testing.T) {
+	fa, dira := buildImage(t, map[string]string{
+		"Apples.txt":            "apples",
+		"Groceries/Bananas.txt": "bananas",
+		"Oranges.txt":           "oranges",
+	}, 4096)
+	defer os.RemoveAll(dira)
+
+	fb, dirb := buildImage(t, map[string]string{
+		"Apples.txt":            "apples",
+		"Groceries/Bananas.txt": "plantains",
+		"Groceries/Figs.txt":    "figs",
+	}, 0)
+	defer os.RemoveAll(dirb)
+
+	a, err := reader.Open(fa)
+	if err != nil {
+		t.Fatalf("reader.Open(%v) failed: %v", fa, err)
+	}
+	defer a.Close()
+
+	b, err := reader.Open(fb)
+	if err != nil {
+		t.Fatalf("reader.Open(%v) failed: %v", fb, err)
+	}
+	defer b.Close()
+
+	if changes := reader.Diff(a, a, reader.DiffOptions{}); len(changes) != 0 {
+		t.Errorf("reader.Diff(a, a) = %v, expected no changes", changes)
+	}
+
+	// The trees were written at different times, so only content is compared
+	changes := reader.Diff(a, b, reader.DiffOptions{IgnoreModTime: true})
+	expected := []reader.Change{
+		{Path: "/Groceries/Bananas.txt", Kind: reader.Modified, Fields: []string{"content"}},
+		{Path: "/Groceries/Figs.txt", Kind: reader.Added},
+		{Path: "/Oranges.txt", Kind: reader.Removed},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("reader.Diff(a, b) = %v, expected %v", changes, expected)
+	}
+}
@@ -0,0 +1,147 @@
+package reader
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"manager"
+)
+
+// DirUsage is the space accounting of a directory, including all its subdirectories
+type DirUsage struct {
+	Path string `json:"path"`
+
+	// Logical is the number of data bytes the files store (End-Begin), i.e. the
+	// compressed size of compressed files. Extents shared by several files are
+	// counted once, as in Taken.
+	Logical int64 `json:"logical"`
+
+	// Taken is the number of bytes the files take in the data region, including
+	// the alignment padding behind them
+	Taken int64 `json:"taken"`
+
+	// Inline is the number of bytes of files stored inline in the metadata, which
+	// take nothing in the data region and are not part of Logical
+	Inline int64 `json:"inline"`
+
+	// Files is the number of regular files
+	Files int `json:"files"`
+}
+
+// Padding returns the bytes of alignment padding behind the files of the directory
+func (d *DirUsage) Padding() int64 {
+	return d.Taken - d.Logical
+}
+
+// DiskUsage accounts the files below the directory root to root and each of its
+// subdirectories up to maxDepth levels below root (all if maxDepth < 0). root comes
+// first, the subdirectories follow in the order they were written.
+func (img *Image) DiskUsage(root string, maxDepth int) []DirUsage {
+	usage := img.extentUsage()
+
+	index := map[string]int{root: 0}
+	dirs := []DirUsage{{Path: root}}
+	for _, e := range img.Entries() {
+		if e.Type != manager.Directory || e.Path == root || !below(e.Path, root) {
+			continue
+		}
+		if maxDepth >= 0 && depthBelow(e.Path, root) > maxDepth {
+			continue
+		}
+		index[e.Path] = len(dirs)
+		dirs = append(dirs, DirUsage{Path: e.Path})
+	}
+
+	for _, e := range img.Entries() {
+		if e.Type != manager.RegularFile || !below(e.Path, root) {
+			continue
+		}
+		// Account the file to every reported directory above it
+		for dir := path.Dir(e.Path); ; dir = path.Dir(dir) {
+			if i, ok := index[dir]; ok {
+				dirs[i].Logical += usage[e.Index].logical
+				dirs[i].Taken += usage[e.Index].taken
+				if e.IsInline() {
+					dirs[i].Inline += e.Size()
+				}
+				dirs[i].Files++
+			}
+			if dir == root || dir == "/" {
+				break
+			}
+		}
+	}
+
+	return dirs
+}
+
+// extentUsage is the space the data of a regular file uses in the data region
+type extentUsage struct {
+	// logical is the size of the stored data (End-Begin)
+	logical int64
+
+	// taken is the size of the data including the padding behind it
+	taken int64
+}
+
+// extentUsage returns, per metadata index of a regular file, the bytes its data
+// stores and takes in the data region: from its Begin to the Begin of the next
+// extent (or the end of the data region). Extents shared by several files are
+// accounted to the first of them only.
+func (img *Image) extentUsage() map[int]extentUsage {
+	var files []int
+	for i := range img.Metadata {
+		if m := &img.Metadata[i]; m.Type == manager.RegularFile && m.Begin >= 0 {
+			files = append(files, i)
+		}
+	}
+	sort.SliceStable(files, func(a, b int) bool {
+		ma, mb := &img.Metadata[files[a]], &img.Metadata[files[b]]
+		return ma.Begin < mb.Begin || ma.Begin == mb.Begin && ma.End < mb.End
+	})
+
+	usage := make(map[int]extentUsage)
+	for k, i := range files {
+		m := &img.Metadata[i]
+		if m.Begin == m.End {
+			continue
+		}
+		if k > 0 {
+			if prev := &img.Metadata[files[k-1]]; prev.Begin == m.Begin && prev.End == m.End {
+				continue
+			}
+		}
+
+		next := img.HeaderLoc
+		for _, j := range files[k+1:] {
+			if b := img.Metadata[j].Begin; b > m.Begin {
+				next = b
+				break
+			}
+		}
+		if next < m.End {
+			next = m.End
+		}
+		usage[i] = extentUsage{logical: m.End - m.Begin, taken: next - m.Begin}
+	}
+
+	return usage
+}
+
+// below returns whether p is root or below it
+func below(p string, root string) bool {
+	return root == "/" || p == root || strings.HasPrefix(p, root+"/")
+}
+
+// depthBelow returns the number of path components of p below root
+func depthBelow(p string, root string) int {
+	if p == root {
+		return 0
+	}
+	rel := p
+	if root != "/" {
+		rel = strings.TrimPrefix(p, root)
+	}
+	return strings.Count(rel, "/")
+}
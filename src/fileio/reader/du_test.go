@@ -0,0 +1,60 @@
+package reader_test
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"fileio/reader"
+	"manager"
+	"stats"
+)
+
+func TestDiskUsage(t *testing.T) {
+	big := strings.Repeat("x", 5000)
+	fn, dir := buildImageWith(t, map[string]string{
+		"a/big.txt":    big,
+		"a/small.txt":  "0123456789",
+		"b/dup.txt":    big,
+		"b/tiny":       "hi",
+		"c/packed.txt": "01234567890123456789",
+	}, &manager.ZarManager{
+		Alignment:     4096,
+		PackThreshold: 100,
+		InlineLimit:   4,
+		Dedup:         true,
+		Statistics:    &stats.ImgStats{},
+	})
+	defer os.RemoveAll(dir)
+
+	img, err := reader.Open(fn)
+	if err != nil {
+		t.Fatalf("reader.Open(%v) failed: %v", fn, err)
+	}
+	defer img.Close()
+
+	// a/big.txt is aligned and padded to 8192, where a/small.txt and then
+	// c/packed.txt are packed. b/dup.txt shares the extent of a/big.txt and b/tiny
+	// is inline.
+	if img.HeaderLoc != 8192+10+20 {
+		t.Fatalf("data region ends at %v, expected %v", img.HeaderLoc, 8192+10+20)
+	}
+	want := []reader.DirUsage{
+		{Path: "/", Logical: 5030, Taken: 8222, Inline: 2, Files: 5},
+		{Path: "/a", Logical: 5010, Taken: 8202, Files: 2},
+		{Path: "/b", Inline: 2, Files: 2},
+		{Path: "/c", Logical: 20, Taken: 20, Files: 1},
+	}
+	got := img.DiskUsage("/", -1)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("img.DiskUsage(/) = %+v, expected %+v", got, want)
+	}
+
+	if got := img.DiskUsage("/a", 0); !reflect.DeepEqual(got, want[1:2]) {
+		t.Errorf("img.DiskUsage(/a, 0) = %+v, expected %+v", got, want[1:2])
+	}
+	if got := img.DiskUsage("/", 0); len(got) != 1 || got[0] != want[0] {
+		t.Errorf("img.DiskUsage(/, 0) = %+v, expected only %+v", got, want[0])
+	}
+}
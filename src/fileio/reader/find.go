@@ -0,0 +1,296 @@
+package reader
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"manager"
+)
+
+// Query selects entries with predicates similar to find(1). Empty fields match any
+// entry, all given fields must match.
+type Query struct {
+	// Name is a glob the base name must match (see path.Match), "[!...]" negates a
+	// class as in find(1)
+	Name string
+
+	// Path is a glob the full path must match, "*" and "?" also match "/"
+	Path string
+
+	// Types lists entry types, comma separated: f (file), d (dir), l (symlink), w (whiteout)
+	Types string
+
+	// Sizes are sizes in bytes [+|-]N[k|M|G]: more than, less than or exactly N
+	Sizes []string
+
+	// MTimes are ages [+|-]N in days: more than, less than or exactly N. Like
+	// find(1), N means between N and N+1 days ago.
+	MTimes []string
+
+	// Newer is an image path or a time (RFC3339 or 2006-01-02) entries are
+	// modified after
+	Newer string
+
+	// Perm are permission bits in octal: exactly MODE, all of -MODE or any of /MODE
+	Perm string
+
+	// Now is the time (ns since epoch) the ages of MTimes count from, the current
+	// time if 0
+	Now int64
+}
+
+// predicate decides whether an entry matches a Query
+type predicate func(e *Entry) bool
+
+// Find returns the entries at or below root that match q, in metadata order
+func (img *Image) Find(root string, q Query) ([]Entry, error) {
+	preds, err := img.predicates(q)
+	if err != nil {
+		return nil, err
+	}
+
+	root = Clean(root)
+	var found []Entry
+	for _, e := range img.Entries() {
+		if root != "/" && e.Path != root && !strings.HasPrefix(e.Path, root+"/") {
+			continue
+		}
+		if matchAll(preds, &e) {
+			found = append(found, e)
+		}
+	}
+	return found, nil
+}
+
+// predicates builds the predicates of q
+func (img *Image) predicates(q Query) ([]predicate, error) {
+	var preds []predicate
+
+	if q.Name != "" {
+		glob := negateClasses(q.Name)
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("bad -name %q: %v", q.Name, err)
+		}
+		preds = append(preds, func(e *Entry) bool {
+			ok, _ := path.Match(glob, e.Name)
+			return ok
+		})
+	}
+
+	if q.Path != "" {
+		re, err := globRegexp(q.Path)
+		if err != nil {
+			return nil, fmt.Errorf("bad -path %q: %v", q.Path, err)
+		}
+		preds = append(preds, func(e *Entry) bool { return re.MatchString(e.Path) })
+	}
+
+	if q.Types != "" {
+		letters := map[string]string{
+			"f": manager.RegularFile.String(),
+			"d": manager.Directory.String(),
+			"l": manager.Symlink.String(),
+			"w": manager.WhiteoutFile.String(),
+		}
+		want := make(map[string]bool)
+		for _, t := range strings.Split(q.Types, ",") {
+			if _, ok := letters[t]; !ok {
+				return nil, fmt.Errorf("unknown type %q, known: f, d, l, w", t)
+			}
+			want[letters[t]] = true
+		}
+		preds = append(preds, func(e *Entry) bool { return want[e.Type.String()] })
+	}
+
+	for _, s := range q.Sizes {
+		cmp, n, err := parseComparison(s, parseSize)
+		if err != nil {
+			return nil, fmt.Errorf("bad -size %q: %v", s, err)
+		}
+		preds = append(preds, func(e *Entry) bool { return compare(e.Size(), cmp, n) })
+	}
+
+	now := q.Now
+	if now == 0 {
+		now = time.Now().UnixNano()
+	}
+	day := int64(24 * time.Hour)
+	for _, s := range q.MTimes {
+		cmp, n, err := parseComparison(s, func(v string) (int64, error) { return strconv.ParseInt(v, 10, 64) })
+		if err != nil {
+			return nil, fmt.Errorf("bad -mtime %q: %v", s, err)
+		}
+		preds = append(preds, func(e *Entry) bool { return compare((now-e.ModTime)/day, cmp, n) })
+	}
+
+	if q.Newer != "" {
+		ref, err := img.parseTimeRef(q.Newer)
+		if err != nil {
+			return nil, fmt.Errorf("bad -newer %q: %v", q.Newer, err)
+		}
+		preds = append(preds, func(e *Entry) bool { return e.ModTime > ref })
+	}
+
+	if q.Perm != "" {
+		p, err := permPredicate(q.Perm)
+		if err != nil {
+			return nil, fmt.Errorf("bad -perm %q: %v", q.Perm, err)
+		}
+		preds = append(preds, p)
+	}
+
+	return preds, nil
+}
+
+// matchAll returns whether every predicate matches e
+func matchAll(preds []predicate, e *Entry) bool {
+	for _, p := range preds {
+		if !p(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// negateClasses rewrites the find(1) class negation "[!...]" of a glob to the
+// "[^...]" of path.Match
+func negateClasses(glob string) string {
+	b := []byte(glob)
+	for i := 0; i < len(b); i++ {
+		switch b[i] {
+		case '\\':
+			i++
+		case '[':
+			if i+1 < len(b) && b[i+1] == '!' {
+				b[i+1] = '^'
+			}
+		}
+	}
+	return string(b)
+}
+
+// globRegexp translates a shell glob (*, ?, [...]) into an anchored regexp in
+// which "*" and "?" also match "/", as for find -path
+func globRegexp(glob string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated [ in %q", glob)
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+			}
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+
+	return regexp.Compile(b.String())
+}
+
+// parseComparison splits "+N", "-N" or "N" into the comparison ('+', '-' or '=') and N
+func parseComparison(s string, parse func(string) (int64, error)) (byte, int64, error) {
+	cmp := byte('=')
+	if strings.HasPrefix(s, "+") || strings.HasPrefix(s, "-") {
+		cmp, s = s[0], s[1:]
+	}
+	n, err := parse(s)
+	return cmp, n, err
+}
+
+// compare compares v against n with a comparison returned by parseComparison
+func compare(v int64, cmp byte, n int64) bool {
+	switch cmp {
+	case '+':
+		return v > n
+	case '-':
+		return v < n
+	}
+	return v == n
+}
+
+// parseSize parses a size in bytes with an optional k, M or G suffix
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "k"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n * mult, err
+}
+
+// parseTimeRef returns the ModTime (ns since epoch) of the entry at the image path
+// ref, or ref parsed as a time
+func (img *Image) parseTimeRef(ref string) (int64, error) {
+	if strings.HasPrefix(ref, "/") {
+		e, ok := img.Lookup(ref)
+		if !ok {
+			return 0, fmt.Errorf("no such file or directory in image")
+		}
+		return e.ModTime, nil
+	}
+
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, ref, time.Local); err == nil {
+			return t.UnixNano(), nil
+		}
+	}
+	return 0, fmt.Errorf("neither an image path nor a time")
+}
+
+// permPredicate parses a find(1) style -perm argument
+func permPredicate(perm string) (predicate, error) {
+	mode := perm
+	if strings.HasPrefix(mode, "-") || strings.HasPrefix(mode, "/") {
+		mode = mode[1:]
+	}
+	bits, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return nil, err
+	}
+	want := uint32(bits)
+
+	switch perm[0] {
+	case '-':
+		return func(e *Entry) bool { return unixPerm(e)&want == want }, nil
+	case '/':
+		return func(e *Entry) bool { return unixPerm(e)&want != 0 }, nil
+	}
+	return func(e *Entry) bool { return unixPerm(e) == want }, nil
+}
+
+// unixPerm returns the permission bits of an entry as in st_mode, including
+// setuid, setgid and sticky
+func unixPerm(e *Entry) uint32 {
+	return e.UnixMode() & 07777
+}
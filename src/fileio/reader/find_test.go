@@ -0,0 +1,144 @@
+package reader_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"fileio/reader"
+	"manager"
+	"stats"
+)
+
+func TestFind(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.Local)
+	files := []struct {
+		path string
+		size int
+		mode os.FileMode
+		age  time.Duration
+	}{
+		{"Apples.txt", 10, 0644, 12 * time.Hour},
+		{"apple.c", 1023, 0644, 12 * time.Hour},
+		{"Groceries/Bananas.txt", 1024, 0600, 84 * time.Hour},
+		{"Groceries/[x].txt", 1025, 0640, 84 * time.Hour},
+		{"Groceries/Sub/Figs.txt", 1 << 20, 0755 | os.ModeSetuid, 252 * time.Hour},
+		{"Tools/run", 1<<20 + 1, 0711, 252 * time.Hour},
+	}
+	root := filepath.Join(dir, "root")
+	for _, f := range files {
+		fn := filepath.Join(root, f.path)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(strings.Repeat("x", f.size)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(fn, f.mode); err != nil {
+			t.Fatal(err)
+		}
+		mtime := now.Add(-f.age)
+		if err := os.Chtimes(fn, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("Apples.txt", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	fn := filepath.Join(dir, "test.img")
+	writeImage(&manager.ZarManager{Statistics: &stats.ImgStats{}}, root, fn)
+	img, err := reader.Open(fn)
+	if err != nil {
+		t.Fatalf("reader.Open(%v) failed: %v", fn, err)
+	}
+	defer img.Close()
+
+	tests := []struct {
+		root     string
+		q        reader.Query
+		expected []string
+	}{
+		{"/", reader.Query{Name: "*.txt"}, []string{"/Apples.txt", "/Groceries/Bananas.txt", "/Groceries/Sub/Figs.txt", "/Groceries/[x].txt"}},
+		{"/Groceries", reader.Query{Name: "*.txt"}, []string{"/Groceries/Bananas.txt", "/Groceries/Sub/Figs.txt", "/Groceries/[x].txt"}},
+		{"/", reader.Query{Name: "[Aa]pple?.*"}, []string{"/Apples.txt"}},
+		{"/", reader.Query{Name: "[!A]*.*"}, []string{"/Groceries/Bananas.txt", "/Groceries/Sub/Figs.txt", "/Groceries/[x].txt", "/apple.c"}},
+		{"/", reader.Query{Name: "[^A]*.*"}, []string{"/Groceries/Bananas.txt", "/Groceries/Sub/Figs.txt", "/Groceries/[x].txt", "/apple.c"}},
+		{"/", reader.Query{Name: `\[x\].txt`}, []string{"/Groceries/[x].txt"}},
+		{"/", reader.Query{Name: "[x].txt"}, nil},
+		{"/", reader.Query{Name: "*/*"}, nil},
+		{"/", reader.Query{Path: "/Groceries/*.txt"}, []string{"/Groceries/Bananas.txt", "/Groceries/Sub/Figs.txt", "/Groceries/[x].txt"}},
+		{"/", reader.Query{Path: "/*/?ub"}, []string{"/Groceries/Sub"}},
+		{"/", reader.Query{Path: "/?roceries?[!B]*"}, []string{"/Groceries/Sub", "/Groceries/Sub/Figs.txt", "/Groceries/[x].txt"}},
+		{"/", reader.Query{Path: `*\[x]*`}, []string{"/Groceries/[x].txt"}},
+		{"/", reader.Query{Path: "*.TXT"}, nil},
+		{"/", reader.Query{Types: "d"}, []string{"/Groceries", "/Groceries/Sub", "/Tools"}},
+		{"/", reader.Query{Types: "l,d", Path: "/[lT]*"}, []string{"/Tools", "/link"}},
+		{"/", reader.Query{Types: "f", Sizes: []string{"1023"}}, []string{"/apple.c"}},
+		{"/", reader.Query{Types: "f", Sizes: []string{"1k"}}, []string{"/Groceries/Bananas.txt"}},
+		{"/", reader.Query{Types: "f", Sizes: []string{"+1k"}}, []string{"/Groceries/Sub/Figs.txt", "/Groceries/[x].txt", "/Tools/run"}},
+		{"/", reader.Query{Types: "f", Sizes: []string{"-1k"}}, []string{"/Apples.txt", "/apple.c"}},
+		{"/", reader.Query{Types: "f", Sizes: []string{"+1k", "-1M"}}, []string{"/Groceries/[x].txt"}},
+		{"/", reader.Query{Types: "f", Sizes: []string{"1M"}}, []string{"/Groceries/Sub/Figs.txt"}},
+		{"/", reader.Query{Types: "f", Sizes: []string{"+1M"}}, []string{"/Tools/run"}},
+		{"/", reader.Query{Types: "f", Sizes: []string{"-1G"}}, []string{"/Apples.txt", "/Groceries/Bananas.txt", "/Groceries/Sub/Figs.txt", "/Groceries/[x].txt", "/Tools/run", "/apple.c"}},
+		{"/", reader.Query{Types: "f", Sizes: []string{"+0G"}}, []string{"/Apples.txt", "/Groceries/Bananas.txt", "/Groceries/Sub/Figs.txt", "/Groceries/[x].txt", "/Tools/run", "/apple.c"}},
+		{"/", reader.Query{Types: "f", MTimes: []string{"0"}, Now: now.UnixNano()}, []string{"/Apples.txt", "/apple.c"}},
+		{"/", reader.Query{Types: "f", MTimes: []string{"3"}, Now: now.UnixNano()}, []string{"/Groceries/Bananas.txt", "/Groceries/[x].txt"}},
+		{"/", reader.Query{Types: "f", MTimes: []string{"+3"}, Now: now.UnixNano()}, []string{"/Groceries/Sub/Figs.txt", "/Tools/run"}},
+		{"/", reader.Query{Types: "f", MTimes: []string{"+0", "-10"}, Now: now.UnixNano()}, []string{"/Groceries/Bananas.txt", "/Groceries/[x].txt"}},
+		{"/", reader.Query{Types: "f", Newer: "/Groceries/Bananas.txt"}, []string{"/Apples.txt", "/apple.c"}},
+		{"/", reader.Query{Types: "f", Newer: now.Add(-100 * time.Hour).Format(time.RFC3339)}, []string{"/Apples.txt", "/Groceries/Bananas.txt", "/Groceries/[x].txt", "/apple.c"}},
+		{"/", reader.Query{Types: "f", Newer: "2020-05-31"}, []string{"/Apples.txt", "/apple.c"}},
+		{"/", reader.Query{Types: "f", Perm: "644"}, []string{"/Apples.txt", "/apple.c"}},
+		{"/", reader.Query{Types: "f", Perm: "755"}, nil},
+		{"/", reader.Query{Types: "f", Perm: "4755"}, []string{"/Groceries/Sub/Figs.txt"}},
+		{"/", reader.Query{Types: "f", Perm: "-4000"}, []string{"/Groceries/Sub/Figs.txt"}},
+		{"/", reader.Query{Types: "f", Perm: "-640"}, []string{"/Apples.txt", "/Groceries/Sub/Figs.txt", "/Groceries/[x].txt", "/apple.c"}},
+		{"/", reader.Query{Types: "f", Perm: "/011"}, []string{"/Groceries/Sub/Figs.txt", "/Tools/run"}},
+		{"/", reader.Query{Types: "f", Perm: "/4"}, []string{"/Apples.txt", "/Groceries/Sub/Figs.txt", "/apple.c"}},
+	}
+	for _, tt := range tests {
+		found, err := img.Find(tt.root, tt.q)
+		if err != nil {
+			t.Errorf("img.Find(%v, %+v) failed: %v", tt.root, tt.q, err)
+			continue
+		}
+		var paths []string
+		for _, e := range found {
+			paths = append(paths, e.Path)
+		}
+		if !reflect.DeepEqual(paths, tt.expected) {
+			t.Errorf("img.Find(%v, %+v) = %v, expected %v", tt.root, tt.q, paths, tt.expected)
+		}
+	}
+
+	for _, q := range []reader.Query{
+		{Name: "[x"},
+		{Path: "/[x"},
+		{Types: "f,x"},
+		{Sizes: []string{"1x"}},
+		{Sizes: []string{"+"}},
+		{Sizes: []string{"1T"}},
+		{MTimes: []string{"1k"}},
+		{Newer: "/missing"},
+		{Newer: "yesterday"},
+		{Perm: "9"},
+		{Perm: "-"},
+		{Perm: "/rwx"},
+	} {
+		if _, err := img.Find("/", q); err == nil {
+			t.Errorf("img.Find(/, %+v) succeeded, expected an error", q)
+		}
+	}
+}
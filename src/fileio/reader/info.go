@@ -0,0 +1,151 @@
+package reader
+
+import (
+	"manager"
+)
+
+// SectionInfo is the location of a section of the image file
+type SectionInfo struct {
+	Offset int64 `json:"offset"`
+	Size   int64 `json:"size"`
+}
+
+// FilterInfo describes the filter stored in the image
+type FilterInfo struct {
+	SectionInfo
+	Name     string  `json:"name"`
+	Active   bool    `json:"active"`
+	Bits     uint64  `json:"bits"`
+	Hashes   uint64  `json:"hashes"`
+	Elements uint64  `json:"elements"`
+	FPProb   float64 `json:"fp_prob"`
+}
+
+// EntryCounts counts the metadata entries of an image by type
+type EntryCounts struct {
+	Files     int `json:"files"`
+	Dirs      int `json:"dirs"`
+	Symlinks  int `json:"symlinks"`
+	Whiteouts int `json:"whiteouts"`
+	DirEnds   int `json:"dir_ends"`
+}
+
+// ImageInfo is the layout report of an image, see Info
+type ImageInfo struct {
+	Image     string      `json:"image"`
+	Size      int64       `json:"size"`
+	Version   int         `json:"version"`
+	Alignment int64       `json:"alignment"`
+	Data      SectionInfo `json:"data"`
+	Metadata  SectionInfo `json:"metadata"`
+	Filter    FilterInfo  `json:"filter"`
+	Index     SectionInfo `json:"index"`
+	Footer    SectionInfo `json:"footer"`
+	Entries   EntryCounts `json:"entries"`
+	FileBytes int64       `json:"file_bytes"`
+	Padding   int64       `json:"padding"`
+	Aligned   int         `json:"aligned"`
+	Mappable  int         `json:"mappable"`
+
+	// Compressed files, see manager.ZarManager.Compression
+	Compressed       int   `json:"compressed"`
+	CompressedRaw    int64 `json:"compressed_raw"`
+	CompressedStored int64 `json:"compressed_stored"`
+
+	// Compression of the metadata and filter sections, see
+	// manager.ZarManager.SectionCodec. SectionRaw is their size before compression.
+	SectionCodec string `json:"section_codec"`
+	SectionRaw   int64  `json:"section_raw"`
+
+	// Packing of small files, see manager.ZarManager.PackThreshold
+	PackThreshold int64 `json:"pack_threshold"`
+	Packed        int   `json:"packed"`
+	PackSaved     int64 `json:"pack_saved"`
+
+	// Files stored inline in the metadata, see manager.ZarManager.InlineLimit
+	InlineLimit int64 `json:"inline_limit"`
+	InlineFiles int   `json:"inline_files"`
+	InlineBytes int64 `json:"inline_bytes"`
+}
+
+// Info collects the layout report of img, whose file is named fn
+func (img *Image) Info(fn string) ImageInfo {
+	size := int64(len(img.Data))
+	fm := img.FilterMetadata
+
+	info := ImageInfo{
+		Image:         fn,
+		Size:          size,
+		Version:       img.Footer.FormatVersion(),
+		Alignment:     img.Footer.Alignment,
+		PackThreshold: img.Footer.PackThreshold,
+		InlineLimit:   img.Footer.InlineLimit,
+		SectionCodec:  img.Footer.SectionCodec,
+		SectionRaw:    img.Footer.MetadataSize + img.Footer.FilterSize,
+		Data:          SectionInfo{0, img.HeaderLoc},
+		Metadata:      SectionInfo{img.HeaderLoc, fm.FilterLoc - img.HeaderLoc},
+		Filter: FilterInfo{
+			SectionInfo: SectionInfo{fm.FilterLoc, fm.FilterStructSize},
+			Name:        fm.Name,
+			Active:      fm.Active,
+			Bits:        img.Filter.FilterSize,
+			Hashes:      img.Filter.NumHashes,
+			Elements:    img.Filter.NumElem,
+			FPProb:      img.Filter.FPProb,
+		},
+		Index:  SectionInfo{img.Footer.IndexLoc, img.Footer.IndexSize},
+		Footer: SectionInfo{img.FooterLoc, size - img.FooterLoc},
+	}
+
+	// Extents shared by several entries are counted once
+	extents := make(map[[2]int64]bool)
+	var aligned int64 // Size of the data region if every file was aligned
+	for i := range img.Metadata {
+		m := &img.Metadata[i]
+		switch m.Type {
+		case manager.RegularFile:
+			info.Entries.Files++
+			if m.IsInline() {
+				info.InlineFiles++
+				info.InlineBytes += m.Size()
+				continue
+			}
+			extent := [2]int64{m.Begin, m.End}
+			if !extents[extent] {
+				extents[extent] = true
+				info.FileBytes += m.End - m.Begin
+				aligned += manager.AlignUp(m.Size(), info.Alignment)
+				if m.Align > 0 {
+					info.Aligned++
+				}
+				if m.MapPage > 0 {
+					info.Mappable++
+				}
+				if m.Codec != "" {
+					info.Compressed++
+					info.CompressedRaw += m.RawSize
+					info.CompressedStored += m.End - m.Begin
+				}
+				if m.Size() < info.PackThreshold {
+					info.Packed++
+				}
+			}
+		case manager.Directory:
+			if m.IsDirEnd() {
+				info.Entries.DirEnds++
+			} else {
+				info.Entries.Dirs++
+			}
+		case manager.Symlink:
+			info.Entries.Symlinks++
+		case manager.WhiteoutFile:
+			info.Entries.Whiteouts++
+		}
+	}
+	info.Padding = info.Data.Size - info.FileBytes
+	if info.PackThreshold > 0 {
+		info.PackSaved = aligned - info.Data.Size
+	}
+
+	return info
+}
@@ -0,0 +1,102 @@
+package reader_test
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"fileio/reader"
+	"manager"
+	"stats"
+)
+
+func TestInfo(t *testing.T) {
+	fn, dir := buildImageWith(t, map[string]string{
+		"Picture.png":    "\x89PNG" + strings.Repeat("x", 4996),
+		"Figs.txt":       "figs figs figs figs ",
+		"Groceries.txt":  strings.Repeat("apples and bananas\n", 50),
+		"Sub/Kiwi.txt":   "kiwi",
+		"Sub/Lemons.txt": strings.Repeat("lemons\n", 200),
+	}, &manager.ZarManager{
+		Alignment:     4096,
+		PackThreshold: 1000,
+		InlineLimit:   4,
+		Compression:   "flate",
+		Statistics:    &stats.ImgStats{},
+	})
+	defer os.RemoveAll(dir)
+
+	img, err := reader.Open(fn)
+	if err != nil {
+		t.Fatalf("reader.Open(%v) failed: %v", fn, err)
+	}
+	defer img.Close()
+
+	info := img.Info("test.img")
+	figs, _ := img.Lookup("/Figs.txt")
+	png, _ := img.Lookup("/Picture.png")
+	groceries, _ := img.Lookup("/Groceries.txt")
+	lemons, _ := img.Lookup("/Sub/Lemons.txt")
+	// Figs.txt is too small for flate to make it smaller
+	if groceries.Codec != "flate" || figs.Codec != "" || lemons.Codec != "" || png.Codec != "" {
+		t.Fatalf("Groceries.txt, Figs.txt, Sub/Lemons.txt and Picture.png are compressed with %q, %q, %q and %q, expected only Groceries.txt with flate",
+			groceries.Codec, figs.Codec, lemons.Codec, png.Codec)
+	}
+
+	stored := groceries.End - groceries.Begin
+	fileBytes := 20 + stored + 1400 + 5000
+	expected := reader.ImageInfo{
+		Image:            "test.img",
+		Size:             int64(len(img.Data)),
+		Version:          manager.FormatVersion,
+		Alignment:        4096,
+		Data:             reader.SectionInfo{Offset: 0, Size: img.HeaderLoc},
+		Metadata:         reader.SectionInfo{Offset: img.HeaderLoc, Size: img.FilterMetadata.FilterLoc - img.HeaderLoc},
+		Index:            reader.SectionInfo{Offset: img.Footer.IndexLoc, Size: img.Footer.IndexSize},
+		Footer:           reader.SectionInfo{Offset: img.FooterLoc, Size: int64(len(img.Data)) - img.FooterLoc},
+		Entries:          reader.EntryCounts{Files: 5, Dirs: 1},
+		FileBytes:        fileBytes,
+		Padding:          img.HeaderLoc - fileBytes,
+		Aligned:          2,
+		Compressed:       1,
+		CompressedRaw:    950,
+		CompressedStored: stored,
+		PackThreshold:    1000,
+		Packed:           2,
+		PackSaved:        5*4096 - img.HeaderLoc,
+		InlineLimit:      4,
+		InlineFiles:      1,
+		InlineBytes:      4,
+	}
+	expected.Filter = info.Filter
+	if info != expected {
+		t.Errorf("img.Info() = %+v, expected %+v", info, expected)
+	}
+
+	// The data region holds Figs.txt and Groceries.txt packed in one page, then
+	// the two aligned files
+	if img.HeaderLoc != 4*4096 || figs.Begin != 0 || groceries.Begin != 20 || png.Begin != 4096 || lemons.Begin != 3*4096 {
+		t.Errorf("data region of %v bytes with Figs.txt at %v, Groceries.txt at %v, Picture.png at %v and Sub/Lemons.txt at %v",
+			img.HeaderLoc, figs.Begin, groceries.Begin, png.Begin, lemons.Begin)
+	}
+	f := info.Filter
+	if f.Offset != img.FilterMetadata.FilterLoc || f.Size != img.FilterMetadata.FilterStructSize || !f.Active ||
+		f.Name != "BloomFilter" || f.Elements != 5 || f.Bits == 0 || f.Hashes == 0 || f.FPProb <= 0 {
+		t.Errorf("img.Info().Filter = %+v", f)
+	}
+
+	// Images written before the footer hold only the filter metadata
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := reader.Decode(withFooter(t, data[:img.FooterLoc], img.FilterMetadata))
+	if err != nil {
+		t.Fatalf("reader.Decode of an image with legacy filter metadata failed: %v", err)
+	}
+	if info := legacy.Info("legacy.img"); info.Version != 1 || info.Alignment != 0 || info.Index.Size != 0 || info.Entries != expected.Entries {
+		t.Errorf("legacy image reported with version %v, alignment %v, index %+v, entries %+v, expected version 1 with no alignment or index",
+			info.Version, info.Alignment, info.Index, info.Entries)
+	}
+}
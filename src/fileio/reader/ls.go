@@ -0,0 +1,157 @@
+package reader
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"manager"
+)
+
+// ListEntry is the JSON representation of a listed entry
+type ListEntry struct {
+	Path    string `json:"path"`
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Mode    string `json:"mode"`
+	Size    int64  `json:"size"`
+	ModTime string `json:"mtime"`
+	Link    string `json:"link,omitempty"`
+	Begin   *int64 `json:"begin,omitempty"`
+	End     *int64 `json:"end,omitempty"`
+	Inline  bool   `json:"inline,omitempty"`
+}
+
+// ListOptions controls how a Listing is written
+type ListOptions struct {
+	// Long adds mode, size, mtime and link target
+	Long bool
+
+	// Offsets adds the begin and end offsets of file data
+	Offsets bool
+}
+
+// Listing holds the entries of the directories listed by List, in the order
+// "ls -R" prints them
+type Listing struct {
+	// Dirs are the paths of the directories listed, "" for a path that is not a
+	// directory and lists only itself
+	Dirs []string
+
+	// Entries are the entries of each of Dirs
+	Entries [][]Entry
+
+	// recursive is set for the listing of a directory tree
+	recursive bool
+}
+
+// List lists the entries at p like "ls": the children of a directory, and of all
+// its subdirectories if recursive, or a path that is not a directory by itself
+func (img *Image) List(p string, recursive bool) (Listing, error) {
+	l := Listing{recursive: recursive}
+	p = Clean(p)
+	if p != "/" {
+		e, found := img.Lookup(p)
+		if !found {
+			return l, fmt.Errorf("%v: no such file or directory", p)
+		}
+		if e.Type != manager.Directory {
+			l.recursive = false
+			l.Dirs = append(l.Dirs, "")
+			l.Entries = append(l.Entries, []Entry{e})
+			return l, nil
+		}
+	}
+	img.listDir(p, recursive, &l)
+	return l, nil
+}
+
+// listDir adds the children of dir, and of all its subdirectories if recursive,
+// to l
+func (img *Image) listDir(dir string, recursive bool, l *Listing) {
+	children := img.Children(dir)
+	l.Dirs = append(l.Dirs, dir)
+	l.Entries = append(l.Entries, children)
+
+	if !recursive {
+		return
+	}
+	for _, e := range children {
+		if e.Type == manager.Directory {
+			img.listDir(e.Path, recursive, l)
+		}
+	}
+}
+
+// JSON returns the entries of l in their JSON representation
+func (l Listing) JSON(offsets bool) []ListEntry {
+	out := []ListEntry{}
+	for _, entries := range l.Entries {
+		for _, e := range entries {
+			out = append(out, NewListEntry(e, offsets))
+		}
+	}
+	return out
+}
+
+// Write writes l as text to w, one entry per line. In a recursive listing the
+// entries of each directory follow a "dir:" header, as with "ls -R".
+func (l Listing) Write(w io.Writer, opts ListOptions) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+	for i, entries := range l.Entries {
+		if l.recursive {
+			if i > 0 {
+				fmt.Fprintln(tw)
+			}
+			fmt.Fprintf(tw, "%v:\n", l.Dirs[i])
+		}
+		for _, e := range entries {
+			writeListEntry(tw, e, opts)
+		}
+	}
+	return tw.Flush()
+}
+
+// writeListEntry writes a single line of the text listing
+func writeListEntry(w io.Writer, e Entry, opts ListOptions) {
+	if opts.Long {
+		fmt.Fprintf(w, "%v\t%v\t%v\t", e.FileMode(), e.Size(), time.Unix(0, e.ModTime).Format("2006-01-02 15:04"))
+	}
+	if opts.Offsets {
+		if e.IsInline() {
+			fmt.Fprintf(w, "inline\t-\t")
+		} else if e.Type == manager.RegularFile {
+			fmt.Fprintf(w, "%v\t%v\t", e.Begin, e.End)
+		} else {
+			fmt.Fprintf(w, "-\t-\t")
+		}
+	}
+
+	if opts.Long && e.Type == manager.Symlink {
+		fmt.Fprintf(w, "%v -> %v\n", e.Name, e.Link)
+	} else {
+		fmt.Fprintf(w, "%v\n", e.Name)
+	}
+}
+
+// NewListEntry converts an entry to its JSON representation, with the offsets of
+// its data if offsets is set
+func NewListEntry(e Entry, offsets bool) ListEntry {
+	out := ListEntry{
+		Path:    e.Path,
+		Name:    e.Name,
+		Type:    e.Type.String(),
+		Mode:    e.FileMode().String(),
+		Size:    e.Size(),
+		ModTime: time.Unix(0, e.ModTime).UTC().Format(time.RFC3339Nano),
+		Link:    e.Link,
+	}
+	if offsets && e.IsInline() {
+		out.Inline = true
+	} else if offsets && e.Type == manager.RegularFile {
+		begin, end := e.Begin, e.End
+		out.Begin, out.End = &begin, &end
+	}
+	return out
+}
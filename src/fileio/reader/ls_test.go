@@ -0,0 +1,151 @@
+package reader_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"fileio/reader"
+	"manager"
+	"stats"
+)
+
+func TestList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mtime := time.Date(2020, 6, 1, 12, 30, 0, 0, time.UTC)
+	root := filepath.Join(dir, "root")
+	for p, content := range map[string]string{
+		"Apples.txt":              "apples",
+		"Groceries/Bananas.txt":   "bananas",
+		"Groceries/Sub/Figs.txt":  "ok",
+		"Groceries/Sub/Dates.txt": "dates",
+	} {
+		fn := filepath.Join(root, p)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("Apples.txt", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"Apples.txt", "Groceries/Bananas.txt", "Groceries/Sub/Figs.txt", "Groceries/Sub/Dates.txt", "Groceries/Sub", "Groceries"} {
+		if err := os.Chtimes(filepath.Join(root, p), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fn := filepath.Join(dir, "test.img")
+	writeImage(&manager.ZarManager{InlineLimit: 2, Statistics: &stats.ImgStats{}}, root, fn)
+	img, err := reader.Open(fn)
+	if err != nil {
+		t.Fatalf("reader.Open(%v) failed: %v", fn, err)
+	}
+	defer img.Close()
+
+	names := func(l reader.Listing) [][]string {
+		var out [][]string
+		for _, entries := range l.Entries {
+			var n []string
+			for _, e := range entries {
+				n = append(n, e.Name)
+			}
+			out = append(out, n)
+		}
+		return out
+	}
+	tests := []struct {
+		p         string
+		recursive bool
+		dirs      []string
+		names     [][]string
+	}{
+		{"/", false, []string{"/"}, [][]string{{"Apples.txt", "Groceries", "link"}}},
+		{"", false, []string{"/"}, [][]string{{"Apples.txt", "Groceries", "link"}}},
+		{"/", true, []string{"/", "/Groceries", "/Groceries/Sub"}, [][]string{
+			{"Apples.txt", "Groceries", "link"}, {"Bananas.txt", "Sub"}, {"Dates.txt", "Figs.txt"},
+		}},
+		{"/Groceries/", true, []string{"/Groceries", "/Groceries/Sub"}, [][]string{{"Bananas.txt", "Sub"}, {"Dates.txt", "Figs.txt"}}},
+		{"/Groceries/Sub", false, []string{"/Groceries/Sub"}, [][]string{{"Dates.txt", "Figs.txt"}}},
+		{"/Groceries/Bananas.txt", true, []string{""}, [][]string{{"Bananas.txt"}}},
+		{"/link", false, []string{""}, [][]string{{"link"}}},
+	}
+	for _, tt := range tests {
+		l, err := img.List(tt.p, tt.recursive)
+		if err != nil {
+			t.Errorf("img.List(%q, %v) failed: %v", tt.p, tt.recursive, err)
+			continue
+		}
+		if !reflect.DeepEqual(l.Dirs, tt.dirs) || !reflect.DeepEqual(names(l), tt.names) {
+			t.Errorf("img.List(%q, %v) = %v %v, expected %v %v", tt.p, tt.recursive, l.Dirs, names(l), tt.dirs, tt.names)
+		}
+	}
+	if _, err := img.List("/Groceries/Kiwi.txt", false); err == nil {
+		t.Errorf("img.List of a missing path succeeded")
+	}
+
+	l, _ := img.List("/Groceries", true)
+	var b bytes.Buffer
+	if err := l.Write(&b, reader.ListOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "/Groceries:\nBananas.txt\nSub\n\n/Groceries/Sub:\nDates.txt\nFigs.txt\n"; b.String() != expected {
+		t.Errorf("recursive listing is\n%v\nexpected\n%v", b.String(), expected)
+	}
+
+	b.Reset()
+	l.Write(&b, reader.ListOptions{Offsets: true})
+	// Apples.txt comes first in the data, Figs.txt is inline. Directories
+	// separated by headers are aligned on their own.
+	expected := "/Groceries:\n" +
+		"6 13 Bananas.txt\n" +
+		"- -  Sub\n\n/Groceries/Sub:\n" +
+		"13     18 Dates.txt\n" +
+		"inline -  Figs.txt\n"
+	if b.String() != expected {
+		t.Errorf("listing with offsets is\n%v\nexpected\n%v", b.String(), expected)
+	}
+
+	l, _ = img.List("/", false)
+	b.Reset()
+	l.Write(&b, reader.ListOptions{Long: true})
+	local := mtime.Local().Format("2006-01-02 15:04")
+	link, _ := img.Lookup("/link")
+	expected = "-rw-r--r-- 6 " + local + " Apples.txt\n" +
+		"drwxr-xr-x 0 " + local + " Groceries\n" +
+		fmt.Sprintf("Lrwxrwxrwx 0 %v link -> Apples.txt\n", time.Unix(0, link.ModTime).Format("2006-01-02 15:04"))
+	if b.String() != expected {
+		t.Errorf("long listing is\n%v\nexpected\n%v", b.String(), expected)
+	}
+
+	l, _ = img.List("/Groceries/Sub", false)
+	out, err := json.Marshal(l.JSON(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `[{"path":"/Groceries/Sub/Dates.txt","name":"Dates.txt","type":"file","mode":"-rw-r--r--","size":5,"mtime":"2020-06-01T12:30:00Z","begin":13,"end":18},` +
+		`{"path":"/Groceries/Sub/Figs.txt","name":"Figs.txt","type":"file","mode":"-rw-r--r--","size":2,"mtime":"2020-06-01T12:30:00Z","inline":true}]`
+	if string(out) != expected {
+		t.Errorf("JSON listing is\n%s\nexpected\n%v", out, expected)
+	}
+	if out, _ := json.Marshal(l.JSON(false)); bytes.Contains(out, []byte("begin")) || bytes.Contains(out, []byte("inline")) {
+		t.Errorf("JSON listing without offsets is %s, expected no offsets", out)
+	}
+	l, _ = img.List("/link", false)
+	if out, _ := json.Marshal(l.JSON(true)); !bytes.Contains(out, []byte(`"type":"symlink","mode":"Lrwxrwxrwx","size":0`)) || !bytes.Contains(out, []byte(`"link":"Apples.txt"}`)) {
+		t.Errorf("JSON listing of a symlink is %s", out)
+	}
+}
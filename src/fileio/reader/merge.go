@@ -0,0 +1,190 @@
+package reader
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"manager"
+)
+
+// MergeTree combines the trees of several images, each grafted at a prefix. Paths
+// present in more than one image are conflicts; directories present in several
+// images are merged.
+type MergeTree struct {
+	root *mergeNode
+}
+
+// mergeNode is an entry of a MergeTree
+type mergeNode struct {
+	// m is the metadata of the entry. Name is the name in the merged tree
+	m manager.FileMetadata
+
+	// img is the image holding the data of a regular file. Nil for directories
+	// created for a prefix
+	img *Image
+
+	// path is the full path of the entry in the merged tree
+	path string
+
+	// source names the image the entry comes from, for conflict reports
+	source string
+
+	// children are the entries of a directory in the order they were grafted
+	children []*mergeNode
+	index    map[string]*mergeNode
+}
+
+// NewMergeTree returns an empty MergeTree
+func NewMergeTree() *MergeTree {
+	return &MergeTree{root: &mergeNode{m: manager.FileMetadata{Type: manager.Directory}, path: "/", index: make(map[string]*mergeNode)}}
+}
+
+// Graft adds the entries of img below prefix to the tree. Directories on the
+// prefix that do not exist yet are created with mode 0755 and ModTime 0. It
+// returns the conflicting paths; the entry of img replaces the existing one only
+// if last is set. source names img in the conflicts.
+func (t *MergeTree) Graft(img *Image, source string, prefix string, last bool) []string {
+	var conflicts []string
+	prefix = Clean(prefix)
+	source = source + ":" + prefix
+
+	// Create the prefix
+	dir := t.root
+	if prefix != "/" {
+		for _, name := range strings.Split(prefix[1:], "/") {
+			m := manager.FileMetadata{Begin: -1, End: -1, Name: name, Type: manager.Directory, Mode: os.ModeDir | 0755}
+			next, c := dir.add(&mergeNode{m: m, source: source}, last)
+			if c != "" {
+				conflicts = append(conflicts, c)
+			}
+			if next.m.Type != manager.Directory {
+				// The prefix is taken by an entry of an earlier image
+				return conflicts
+			}
+			dir = next
+		}
+	}
+
+	for _, e := range img.Entries() {
+		parent := dir.lookup(path.Dir(e.Path))
+		if parent == nil || parent.m.Type != manager.Directory {
+			// The parent directory lost a conflict
+			continue
+		}
+
+		n := &mergeNode{m: e.FileMetadata, img: img, source: source}
+		if _, c := parent.add(n, last); c != "" {
+			conflicts = append(conflicts, c)
+		}
+	}
+
+	return conflicts
+}
+
+// Alignments returns a policy keeping the alignment each regular file had in its
+// source image. Files of images before format version 10, which do not record
+// it, get the alignment of the layout.
+func (t *MergeTree) Alignments() manager.AlignPolicy {
+	return manager.AlignPolicyFunc(func(p string, size int64, head []byte) (int64, bool) {
+		n := t.root.lookup(p)
+		if n == nil || n.img == nil || n.img.Footer.FormatVersion() < 10 {
+			return 0, false
+		}
+		return n.m.Align, true
+	})
+}
+
+// Write writes the merged tree to the image of z, whose Writer is initialized.
+// Data is copied straight from the source images.
+func (t *MergeTree) Write(z *manager.ZarManager) error {
+	if err := t.root.write(z); err != nil {
+		return err
+	}
+	z.GenerateFilter()
+	return z.WriteHeader()
+}
+
+// add adds n as a child of the directory d. If the name is taken, directories are
+// merged and other entries conflict: n replaces the existing entry if last is set.
+// It returns the entry now in the tree under that name and the conflict, if any.
+func (d *mergeNode) add(n *mergeNode, last bool) (*mergeNode, string) {
+	name := n.m.Name
+	n.path = path.Join(d.path, name)
+	existing, ok := d.index[name]
+	if !ok {
+		if n.m.Type == manager.Directory {
+			n.index = make(map[string]*mergeNode)
+		}
+		d.index[name] = n
+		d.children = append(d.children, n)
+		return n, ""
+	}
+
+	if existing.m.Type == manager.Directory && n.m.Type == manager.Directory {
+		if last && n.img != nil {
+			existing.m.ModTime, existing.m.Mode, existing.source = n.m.ModTime, n.m.Mode, n.source
+		}
+		return existing, ""
+	}
+
+	conflict := fmt.Sprintf("%v: %v from %v and %v from %v", n.path, existing.m.Type, existing.source, n.m.Type, n.source)
+	if !last {
+		return existing, conflict
+	}
+
+	if n.m.Type == manager.Directory {
+		n.index = make(map[string]*mergeNode)
+	}
+	*existing = *n
+	return existing, conflict
+}
+
+// lookup returns the entry at p relative to d, nil if there is none
+func (d *mergeNode) lookup(p string) *mergeNode {
+	n := d
+	for _, name := range strings.Split(strings.Trim(p, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		if n.index == nil {
+			return nil
+		}
+		if n = n.index[name]; n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+// write writes the children of the directory d depth first
+func (d *mergeNode) write(z *manager.ZarManager) error {
+	for _, n := range d.children {
+		m := &n.m
+		switch m.Type {
+		case manager.RegularFile:
+			content, err := n.img.Content(m)
+			if err != nil {
+				return err
+			}
+			h, err := z.WriteContent(n.path, content)
+			if err != nil {
+				return fmt.Errorf("can't write %v: %v", m.Name, err)
+			}
+			h.Name, h.ModTime, h.Mode = m.Name, m.ModTime, m.Mode
+			z.IncludeFileMetadata(h)
+		case manager.Directory:
+			z.IncludeFolderBegin(m.Name, m.ModTime, m.Mode)
+			if err := n.write(z); err != nil {
+				return err
+			}
+			z.IncludeFolderEnd()
+		case manager.Symlink:
+			z.IncludeSymlink(m.Name, m.Link, m.ModTime, m.Mode)
+		case manager.WhiteoutFile:
+			z.IncludeWhiteoutFile(m.Name, m.ModTime)
+		}
+	}
+	return nil
+}
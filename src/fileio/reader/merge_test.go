@@ -0,0 +1,177 @@
+package reader_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"fileio/reader"
+	"manager"
+	"stats"
+)
+
+func TestMergeTree(t *testing.T) {
+	fa, dira := buildImage(t, map[string]string{
+		"Apples.txt":            "apples",
+		"Groceries/Bananas.txt": "bananas",
+		"Fruit":                 "not a directory",
+	}, 4096)
+	defer os.RemoveAll(dira)
+
+	fb, dirb := buildImage(t, map[string]string{
+		"Apples.txt":         "green apples",
+		"Groceries/Figs.txt": "figs",
+		"Fruit/Kiwi.txt":     "kiwi",
+	}, 0)
+	defer os.RemoveAll(dirb)
+
+	a, err := reader.Open(fa)
+	if err != nil {
+		t.Fatalf("reader.Open(%v) failed: %v", fa, err)
+	}
+	defer a.Close()
+
+	b, err := reader.Open(fb)
+	if err != nil {
+		t.Fatalf("reader.Open(%v) failed: %v", fb, err)
+	}
+	defer b.Close()
+
+	// The error policy of "zar merge" fails on the conflicts reported with last unset
+	tests := []struct {
+		name      string
+		prefix    string
+		last      bool
+		conflicts []string
+		contents  map[string]string
+		missing   []string
+	}{
+		{
+			name:   "first",
+			prefix: "/",
+			conflicts: []string{
+				"/Apples.txt: file from a:/ and file from b:/",
+				"/Fruit: file from a:/ and dir from b:/",
+			},
+			contents: map[string]string{
+				"/Apples.txt":            "apples",
+				"/Fruit":                 "not a directory",
+				"/Groceries/Bananas.txt": "bananas",
+				"/Groceries/Figs.txt":    "figs",
+			},
+			missing: []string{"/Fruit/Kiwi.txt"},
+		},
+		{
+			name:   "last",
+			prefix: "/",
+			last:   true,
+			conflicts: []string{
+				"/Apples.txt: file from a:/ and file from b:/",
+				"/Fruit: file from a:/ and dir from b:/",
+			},
+			contents: map[string]string{
+				"/Apples.txt":            "green apples",
+				"/Fruit/Kiwi.txt":        "kiwi",
+				"/Groceries/Bananas.txt": "bananas",
+				"/Groceries/Figs.txt":    "figs",
+			},
+		},
+		{
+			name:   "prefix",
+			prefix: "/opt/tool",
+			contents: map[string]string{
+				"/Apples.txt":                  "apples",
+				"/Fruit":                       "not a directory",
+				"/Groceries/Bananas.txt":       "bananas",
+				"/opt/tool/Apples.txt":         "green apples",
+				"/opt/tool/Fruit/Kiwi.txt":     "kiwi",
+				"/opt/tool/Groceries/Figs.txt": "figs",
+			},
+			missing: []string{"/Groceries/Figs.txt"},
+		},
+		{
+			name:      "prefix taken first",
+			prefix:    "/Fruit/sub",
+			conflicts: []string{"/Fruit: file from a:/ and dir from b:/Fruit/sub"},
+			contents:  map[string]string{"/Fruit": "not a directory", "/Apples.txt": "apples"},
+			missing:   []string{"/Fruit/sub", "/Fruit/sub/Apples.txt"},
+		},
+		{
+			name:      "prefix taken last",
+			prefix:    "/Fruit/sub",
+			last:      true,
+			conflicts: []string{"/Fruit: file from a:/ and dir from b:/Fruit/sub"},
+			contents:  map[string]string{"/Fruit/sub/Apples.txt": "green apples", "/Apples.txt": "apples"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tree := reader.NewMergeTree()
+			conflicts := tree.Graft(a, "a", "/", tt.last)
+			conflicts = append(conflicts, tree.Graft(b, "b", tt.prefix, tt.last)...)
+			if !reflect.DeepEqual(conflicts, tt.conflicts) {
+				t.Errorf("conflicts = %q, expected %q", conflicts, tt.conflicts)
+			}
+
+			fn := filepath.Join(dira, "merged.img")
+			z := &manager.ZarManager{Policy: tree.Alignments(), Statistics: &stats.ImgStats{}}
+			z.Writer.Init(fn)
+			if err := tree.Write(z); err != nil {
+				t.Fatalf("tree.Write failed: %v", err)
+			}
+
+			img, err := reader.Open(fn)
+			if err != nil {
+				t.Fatalf("reader.Open(%v) failed: %v", fn, err)
+			}
+			defer img.Close()
+
+			for p, content := range tt.contents {
+				e, ok := img.Lookup(p)
+				if !ok {
+					t.Errorf("%v is missing", p)
+					continue
+				}
+				if got, err := img.Content(&e.FileMetadata); err != nil || string(got) != content {
+					t.Errorf("img.Content(%v) = %q, %v, expected %q", p, got, err, content)
+				}
+			}
+			for _, p := range tt.missing {
+				if _, ok := img.Lookup(p); ok {
+					t.Errorf("%v is in the merged image", p)
+				}
+			}
+			if problems := img.Verify(); len(problems) != 0 {
+				t.Errorf("img.Verify() = %v, expected no problems", problems)
+			}
+
+			// Files keep the alignment of their source image, a is aligned to 4096
+			fromA := map[string]bool{"apples": true, "bananas": true, "not a directory": true}
+			for p, content := range tt.contents {
+				if e, _ := img.Lookup(p); (e.Align == 4096 && e.Begin%4096 == 0) != fromA[content] {
+					t.Errorf("%v has alignment %v at %v, expected the alignment of its source image", p, e.Align, e.Begin)
+				}
+			}
+		})
+	}
+
+	tree := reader.NewMergeTree()
+	tree.Graft(b, "b", "/opt/tool", false)
+	fn := filepath.Join(dira, "prefix.img")
+	z := &manager.ZarManager{Statistics: &stats.ImgStats{}}
+	z.Writer.Init(fn)
+	if err := tree.Write(z); err != nil {
+		t.Fatalf("tree.Write failed: %v", err)
+	}
+	img, err := reader.Open(fn)
+	if err != nil {
+		t.Fatalf("reader.Open(%v) failed: %v", fn, err)
+	}
+	defer img.Close()
+	for _, p := range []string{"/opt", "/opt/tool"} {
+		if e, ok := img.Lookup(p); !ok || e.Type != manager.Directory || e.Mode != os.ModeDir|0755 || e.ModTime != 0 {
+			t.Errorf("prefix directory %v = %+v, expected a directory with mode 0755 and ModTime 0", p, e)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package reader
+
+import (
+	"path"
+	"syscall"
+
+	"manager"
+)
+
+// Directory entry types as in the d_type of getdents(2)
+const (
+	DTUnknown = 0
+	DTChr     = 2
+	DTDir     = 4
+	DTReg     = 8
+	DTLnk     = 10
+)
+
+// Dirent is a directory entry returned by ReadDir
+type Dirent struct {
+	Entry
+
+	// Ino is the inode number of the entry, see Image.Ino
+	Ino uint64
+
+	// Type is the d_type of the entry
+	Type uint8
+
+	// Off is the cookie to continue reading the directory after this entry
+	Off uint64
+}
+
+// DType returns the d_type of an entry. Whiteouts are character devices.
+func DType(m *manager.FileMetadata) uint8 {
+	switch m.Type {
+	case manager.RegularFile:
+		return DTReg
+	case manager.Directory:
+		return DTDir
+	case manager.Symlink:
+		return DTLnk
+	case manager.WhiteoutFile:
+		return DTChr
+	}
+	return DTUnknown
+}
+
+// Ino returns the inode number of e. Images written before inode numbers were
+// stored (format version 7) derive it from the index of the entry the same way.
+func (img *Image) Ino(e *Entry) uint64 {
+	if e.Index < 0 {
+		return manager.RootIno
+	}
+	if e.Ino != 0 {
+		return e.Ino
+	}
+	return uint64(e.Index) + 2
+}
+
+// Nlink returns the number of names of e: the number of hard links for regular
+// files, 2 for directories and 1 otherwise
+func (img *Image) Nlink(e *Entry) uint64 {
+	switch {
+	case e.Type == manager.Directory:
+		return 2
+	case e.Type != manager.RegularFile || e.Ino == 0:
+		return 1
+	}
+
+	img.nlinkOnce.Do(func() {
+		img.nlink = make(map[uint64]uint64)
+		for i := range img.Metadata {
+			if m := &img.Metadata[i]; m.Type == manager.RegularFile && m.Ino != 0 {
+				img.nlink[m.Ino]++
+			}
+		}
+	})
+	return img.nlink[e.Ino]
+}
+
+// ReadDir reads up to n entries (all if n <= 0) of the directory dir, starting at
+// cookie. The listing is ".", ".." and then the children of dir. It returns the
+// entries and the cookie to continue after them, which equals cookie at the end of
+// the directory.
+//
+// Cookies are positions in the listing, so they stay valid for as long as the
+// image is not rewritten: a reader can save the Off of any entry and resume there.
+// Errors are syscall.ENOENT if dir does not exist and syscall.ENOTDIR if it is not
+// a directory.
+func (img *Image) ReadDir(dir string, cookie uint64, n int) ([]Dirent, uint64, error) {
+	d := img.Root()
+	if p := Clean(dir); p != "/" {
+		e, ok := img.Lookup(p)
+		if !ok {
+			return nil, cookie, syscall.ENOENT
+		}
+		d = e
+	}
+	if d.Type != manager.Directory {
+		return nil, cookie, syscall.ENOTDIR
+	}
+
+	children := img.children(d.Index)
+	total := uint64(len(children)) + 2
+
+	var dirents []Dirent
+	for off := cookie; off < total && (n <= 0 || len(dirents) < n); off++ {
+		var e Entry
+		switch off {
+		case 0:
+			e = d
+			e.Name = "."
+		case 1:
+			e = img.Parent(d)
+			e.Name = ".."
+		default:
+			i := children[off-2]
+			e = Entry{FileMetadata: img.Metadata[i], Index: i, Path: path.Join(d.Path, img.Metadata[i].Name)}
+		}
+		dirents = append(dirents, Dirent{Entry: e, Ino: img.Ino(&e), Type: DType(&e.FileMetadata), Off: off + 1})
+	}
+
+	if len(dirents) == 0 {
+		return nil, cookie, nil
+	}
+	return dirents, dirents[len(dirents)-1].Off, nil
+}
+
+// Parent returns the directory containing e. The root is its own parent.
+func (img *Image) Parent(e Entry) Entry {
+	if e.Index < 0 {
+		return e
+	}
+	if p, ok := img.EntryAt(e.Parent); ok {
+		return p
+	}
+	return img.Root()
+}
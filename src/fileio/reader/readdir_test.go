@@ -0,0 +1,177 @@
+package reader_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"fileio/reader"
+	"manager"
+	"stats"
+)
+
+// names returns the names of dirents
+func names(dirents []reader.Dirent) []string {
+	var n []string
+	for _, d := range dirents {
+		n = append(n, d.Name)
+	}
+	return n
+}
+
+func TestReadDir(t *testing.T) {
+	fn, dir := buildImage(t, map[string]string{
+		"Apples.txt":             "apples",
+		"Groceries/Bananas.txt":  "bananas",
+		"Groceries/Cherries.txt": "cherries",
+		"Groceries/Dates.txt":    "dates",
+		"Groceries/Sub/Figs.txt": "figs",
+	}, 0)
+	defer os.RemoveAll(dir)
+
+	img, err := reader.Open(fn)
+	if err != nil {
+		t.Fatalf("reader.Open(%v) failed: %v", fn, err)
+	}
+	defer img.Close()
+
+	all, next, err := img.ReadDir("/Groceries", 0, 0)
+	if err != nil {
+		t.Fatalf("ReadDir(/Groceries) failed: %v", err)
+	}
+	want := []string{".", "..", "Bananas.txt", "Cherries.txt", "Dates.txt", "Sub"}
+	if got := names(all); !reflect.DeepEqual(got, want) {
+		t.Fatalf("ReadDir(/Groceries) = %v, want %v", got, want)
+	}
+	if next != uint64(len(want)) {
+		t.Errorf("ReadDir(/Groceries) next = %v, want %v", next, len(want))
+	}
+	if all[0].Type != reader.DTDir || all[2].Type != reader.DTReg || all[5].Type != reader.DTDir {
+		t.Errorf("ReadDir(/Groceries) types = %v %v %v", all[0].Type, all[2].Type, all[5].Type)
+	}
+	if all[1].Ino != manager.RootIno {
+		t.Errorf("ino of /Groceries/.. = %v, want %v", all[1].Ino, manager.RootIno)
+	}
+
+	// Paging with any count gives the same listing
+	for n := 1; n <= 3; n++ {
+		var paged []reader.Dirent
+		for cookie := uint64(0); ; {
+			page, next, err := img.ReadDir("/Groceries", cookie, n)
+			if err != nil {
+				t.Fatalf("ReadDir(/Groceries, %v, %v) failed: %v", cookie, n, err)
+			}
+			if len(page) > n {
+				t.Fatalf("ReadDir(/Groceries, %v, %v) returned %v entries", cookie, n, len(page))
+			}
+			if len(page) == 0 {
+				if next != cookie {
+					t.Errorf("ReadDir(/Groceries, %v, %v) at end: next = %v", cookie, n, next)
+				}
+				break
+			}
+			paged = append(paged, page...)
+			cookie = next
+		}
+		if !reflect.DeepEqual(paged, all) {
+			t.Errorf("ReadDir(/Groceries) in pages of %v = %v, want %v", n, names(paged), want)
+		}
+	}
+
+	// Resuming from the cookie of any entry continues after it
+	for i, d := range all {
+		rest, _, err := img.ReadDir("/Groceries", d.Off, 0)
+		if err != nil {
+			t.Fatalf("ReadDir(/Groceries, %v) failed: %v", d.Off, err)
+		}
+		if !reflect.DeepEqual(names(rest), names(all[i+1:])) {
+			t.Errorf("ReadDir(/Groceries, %v) = %v, want %v", d.Off, names(rest), names(all[i+1:]))
+		}
+	}
+	if rest, next, _ := img.ReadDir("/Groceries", 100, 0); len(rest) != 0 || next != 100 {
+		t.Errorf("ReadDir(/Groceries, 100) = %v, %v, want no entries", names(rest), next)
+	}
+
+	// Inode numbers are unique and the same when the image is opened again
+	inos := map[uint64]string{manager.RootIno: "/"}
+	for _, e := range img.Entries() {
+		ino := img.Ino(&e)
+		if other, ok := inos[ino]; ok {
+			t.Errorf("ino %v of %v is also the ino of %v", ino, e.Path, other)
+		}
+		inos[ino] = e.Path
+	}
+	again, err := reader.Open(fn)
+	if err != nil {
+		t.Fatalf("reader.Open(%v) failed: %v", fn, err)
+	}
+	defer again.Close()
+	if got, _, _ := again.ReadDir("/Groceries", 0, 0); !reflect.DeepEqual(got, all) {
+		t.Errorf("ReadDir(/Groceries) after reopening = %v, want %v", got, all)
+	}
+
+	if _, _, err := img.ReadDir("/Missing", 0, 0); err != syscall.ENOENT {
+		t.Errorf("ReadDir(/Missing) error = %v, want %v", err, syscall.ENOENT)
+	}
+	if _, _, err := img.ReadDir("/Apples.txt", 0, 0); err != syscall.ENOTDIR {
+		t.Errorf("ReadDir(/Apples.txt) error = %v, want %v", err, syscall.ENOTDIR)
+	}
+}
+
+func TestHardLinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "root")
+	if err := os.MkdirAll(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "a.txt"), []byte("linked"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "b.txt"), []byte("single"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(root, "a.txt"), filepath.Join(root, "sub", "c.txt")); err != nil {
+		t.Skipf("can't create hard link: %v", err)
+	}
+
+	z := &manager.ZarManager{Statistics: &stats.ImgStats{}}
+	fn := filepath.Join(dir, "test.img")
+	z.Writer.Init(fn)
+	z.WalkDir(root, root, 0, 0, true)
+	z.GenerateFilter()
+	z.WriteHeader()
+
+	img, err := reader.Open(fn)
+	if err != nil {
+		t.Fatalf("reader.Open(%v) failed: %v", fn, err)
+	}
+	defer img.Close()
+
+	a, _ := img.Lookup("/a.txt")
+	b, _ := img.Lookup("/b.txt")
+	c, _ := img.Lookup("/sub/c.txt")
+	if img.Ino(&a) != img.Ino(&c) || img.Ino(&a) == img.Ino(&b) {
+		t.Errorf("inos of a.txt, b.txt, sub/c.txt = %v, %v, %v, want a.txt and sub/c.txt to share one",
+			img.Ino(&a), img.Ino(&b), img.Ino(&c))
+	}
+	if a.Begin != c.Begin || a.End != c.End {
+		t.Errorf("a.txt [%v, %v) and sub/c.txt [%v, %v) don't share their data", a.Begin, a.End, c.Begin, c.End)
+	}
+	if n := img.Nlink(&c); n != 2 {
+		t.Errorf("Nlink(sub/c.txt) = %v, want 2", n)
+	}
+	if n := img.Nlink(&b); n != 1 {
+		t.Errorf("Nlink(b.txt) = %v, want 1", n)
+	}
+	if errs := img.Verify(); len(errs) != 0 {
+		t.Errorf("Verify() = %v, want no errors", errs)
+	}
+}
@@ -1 +1,596 @@
-// TODO: Make a generic reader for the image file and config file
+// TODO: Make a generic reader for the config file
+// Package reader implements a library for reading an image file
+package reader
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"codec"
+	"filter"
+	"manager"
+)
+
+const (
+	locSize     = binary.MaxVarintLen64 // Size of a location written by FileWriter.WriteInt64
+	maxSymlinks = 40                    // Symlinks followed by Resolve before giving up, as in Linux
+
+	// maxSectionSize bounds the decompressed size of a section or file for codecs
+	// that are not codec.Bounded, so corrupt metadata can't make readers allocate
+	// without limit
+	maxSectionSize = 1 << 32
+)
+
+// Image is an image file mapped into memory together with its decoded metadata.
+//
+// Layout of the image file:
+//
+//	| file data | file metadata | metadata loc | filter | path index | footer | footer loc |
+type Image struct {
+	// Data is the read-only mapping of the whole image file
+	Data []byte
+
+	// HeaderLoc is the offset of the file metadata, which is also the end of the data region
+	HeaderLoc int64
+
+	// FooterLoc is the offset of the encoded footer at the end of the image
+	FooterLoc int64
+
+	// Footer is the decoded footer at the end of the image
+	Footer manager.Footer
+
+	// FilterMetadata holds the filter fields of the footer
+	FilterMetadata filter.FilterMetadata
+
+	// Filter is the decoded filter stored in the image
+	Filter filter.BloomFilter
+
+	// Metadata is the list of FileMetadata in the order it was written
+	Metadata []manager.FileMetadata
+
+	// index is the path index section of the image, empty for images without one
+	index []byte
+
+	// entries caches the result of Entries, computed once
+	entries     []Entry
+	entriesOnce sync.Once
+
+	// nlink counts the regular files sharing each inode number, computed once by Nlink
+	nlink     map[uint64]uint64
+	nlinkOnce sync.Once
+
+	// f is the image file backing Data. Nil when the image was decoded from memory
+	f *os.File
+}
+
+// Entry is a FileMetadata together with its position and full path in the image
+type Entry struct {
+	manager.FileMetadata
+
+	// Index is the index of the entry in Image.Metadata
+	Index int
+
+	// Path is the full path of the entry in the image, e.g. "/usr/lib/x.so"
+	Path string
+}
+
+// Open maps the image file fn read-only into memory and decodes its metadata.
+// The image must be closed with Close once it is no longer used.
+func Open(fn string) (*Image, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	length := int(fi.Size()) // MMAP limitation. May not support large file in32 bit system
+	if length == 0 {
+		f.Close()
+		return nil, fmt.Errorf("image file %v is empty", fn)
+	}
+
+	mmap, err := syscall.Mmap(int(f.Fd()), 0, length, syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("can't mmap image file %v, err: %v", fn, err)
+	}
+
+	img, err := Decode(mmap)
+	if err != nil {
+		syscall.Munmap(mmap)
+		f.Close()
+		return nil, err
+	}
+	img.f = f
+
+	return img, nil
+}
+
+// Decode decodes the metadata of an image held in memory.
+func Decode(data []byte) (*Image, error) {
+	img := &Image{Data: data}
+
+	// Footer location is the last int64 of the image
+	footerLoc, err := readLoc(data, int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("can't read footer location, err: %v", err)
+	}
+	img.FooterLoc = footerLoc
+
+	// Images written before the footer existed hold only the filter metadata,
+	// which decodes into the filter fields of the footer
+	gob.Register(manager.Footer{})
+	if err := decodeSection(data[footerLoc:len(data)-locSize], &img.Footer); err != nil {
+		return nil, fmt.Errorf("can't decode footer, err: %v", err)
+	}
+	img.FilterMetadata = img.Footer.FilterMetadata()
+
+	filterLoc := img.FilterMetadata.FilterLoc
+	filterEnd := filterLoc + img.FilterMetadata.FilterStructSize
+	if filterLoc < locSize || filterEnd > footerLoc || filterLoc > filterEnd {
+		return nil, fmt.Errorf("filter location [%v, %v) out of range", filterLoc, filterEnd)
+	}
+
+	gob.Register(filter.BloomFilter{})
+	sectionCodec := img.Footer.SectionCodec
+	if err := decodeCompressedSection(data[filterLoc:filterEnd], sectionCodec, img.Footer.FilterSize, &img.Filter); err != nil {
+		return nil, fmt.Errorf("can't decode filter, err: %v", err)
+	}
+
+	// File metadata location is the int64 right before the filter
+	headerLoc, err := readLoc(data, filterLoc)
+	if err != nil {
+		return nil, fmt.Errorf("can't read metadata location, err: %v", err)
+	}
+	img.HeaderLoc = headerLoc
+
+	gob.Register(manager.FileMetadata{})
+	gob.Register([]manager.FileMetadata{})
+	if err := decodeCompressedSection(data[headerLoc:filterLoc-locSize], sectionCodec, img.Footer.MetadataSize, &img.Metadata); err != nil {
+		return nil, fmt.Errorf("can't decode file metadata, err: %v", err)
+	}
+	if img.Footer.FormatVersion() < 6 {
+		manager.LinkParents(img.Metadata)
+	}
+
+	if size := img.Footer.IndexSize; size > 0 {
+		indexLoc := img.Footer.IndexLoc
+		if indexLoc < filterEnd || indexLoc+size > footerLoc || size%manager.IndexEntrySize != 0 {
+			return nil, fmt.Errorf("path index [%v, %v) out of range", indexLoc, indexLoc+size)
+		}
+		img.index = data[indexLoc : indexLoc+size]
+	}
+
+	return img, nil
+}
+
+// Close unmaps the image and closes the image file
+func (img *Image) Close() error {
+	if img.f == nil {
+		return nil
+	}
+
+	err := syscall.Munmap(img.Data)
+	if cerr := img.f.Close(); err == nil {
+		err = cerr
+	}
+	img.Data = nil
+	img.f = nil
+
+	return err
+}
+
+// Entries returns every file, symlink, whiteout and directory of the image in
+// the order they were written. Directory end markers are not included.
+func (img *Image) Entries() []Entry {
+	img.entriesOnce.Do(func() {
+		entries := []Entry{}
+		manager.Walk(img.Metadata, func(i int, p string, m *manager.FileMetadata) error {
+			entries = append(entries, Entry{FileMetadata: *m, Index: i, Path: p})
+			return nil
+		})
+		img.entries = entries
+	})
+
+	return img.entries
+}
+
+// Stat returns the entry with the full path p by scanning every entry of the image.
+// Lookup is faster for images with a path index. The root "/" is not an entry of the image.
+func (img *Image) Stat(p string) (Entry, bool) {
+	p = Clean(p)
+	for _, e := range img.Entries() {
+		if e.Path == p {
+			return e, true
+		}
+	}
+	return Entry{}, false
+}
+
+// Lookup returns the entry with the full path p using the path index of the image,
+// without reconstructing the paths of other entries. Images without an index are
+// searched one directory at a time, skipping the subtrees of the other entries.
+// The root "/" is not an entry of the image.
+func (img *Image) Lookup(p string) (Entry, bool) {
+	p = Clean(p)
+	if p == "/" {
+		return Entry{}, false
+	}
+
+	var i int
+	var ok bool
+	if len(img.index) > 0 {
+		i, ok = img.lookupIndex(p)
+	} else {
+		i, ok = img.lookupTree(p)
+	}
+	if !ok {
+		return Entry{}, false
+	}
+	return Entry{FileMetadata: img.Metadata[i], Index: i, Path: p}, true
+}
+
+// lookupTree returns the metadata index of the clean path p by searching the
+// children of each directory along p
+func (img *Image) lookupTree(p string) (int, bool) {
+	dir := -1
+	for _, name := range strings.Split(p[1:], "/") {
+		if dir >= 0 && img.Metadata[dir].Type != manager.Directory {
+			return 0, false
+		}
+		i, ok := img.child(dir, name)
+		if !ok {
+			return 0, false
+		}
+		dir = i
+	}
+	return dir, true
+}
+
+// child returns the metadata index of the entry name directly inside the directory
+// dir (-1 for the root). Child tables are binary searched.
+func (img *Image) child(dir int, name string) (int, bool) {
+	if table, ok := img.childTable(dir); ok {
+		k := sort.Search(len(table), func(k int) bool {
+			return img.Metadata[table[k]].Name >= name
+		})
+		if k < len(table) && img.Metadata[table[k]].Name == name {
+			return table[k], true
+		}
+		return 0, false
+	}
+
+	for _, i := range img.children(dir) {
+		if img.Metadata[i].Name == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// children returns the metadata indices of the entries directly inside the
+// directory dir (-1 for the root), from its child table or by skipping the
+// subtrees of the other entries
+func (img *Image) children(dir int) []int {
+	if table, ok := img.childTable(dir); ok {
+		return table
+	}
+
+	begin, end := 0, len(img.Metadata)
+	if dir >= 0 {
+		begin, end = dir+1, img.subtreeEnd(dir)
+	}
+
+	var indices []int
+	for i := begin; i < end; i = img.skip(i) {
+		if !img.Metadata[i].IsDirEnd() {
+			indices = append(indices, i)
+		}
+	}
+	return indices
+}
+
+// childTable returns the child table of the directory dir (-1 for the root) if the
+// image stores sorted child tables and the table is consistent with the metadata
+func (img *Image) childTable(dir int) ([]int, bool) {
+	if !img.Footer.SortedChildren {
+		return nil, false
+	}
+
+	table := img.Footer.RootChildren
+	if dir >= 0 {
+		m := &img.Metadata[dir]
+		if len(m.Children) != m.NumChildren {
+			return nil, false
+		}
+		table = m.Children
+	}
+	for _, i := range table {
+		if i <= dir || i >= len(img.Metadata) {
+			return nil, false
+		}
+	}
+	return table, true
+}
+
+// skip returns the index following the entry i and, for a directory, its subtree
+func (img *Image) skip(i int) int {
+	if m := &img.Metadata[i]; m.Type != manager.Directory || m.IsDirEnd() {
+		return i + 1
+	}
+	return img.subtreeEnd(i)
+}
+
+// subtreeEnd returns the index following the last entry inside the directory i.
+// Directories without a skip pointer are scanned.
+func (img *Image) subtreeEnd(i int) int {
+	if end := img.Metadata[i].SubtreeEnd; end > i && end <= len(img.Metadata) {
+		return end
+	}
+
+	// Entries inside the directory follow it, each one after its parent
+	j := i + 1
+	for ; j < len(img.Metadata) && img.inside(j, i); j++ {
+	}
+	return j
+}
+
+// inside reports whether the entry j is inside the directory i, directly or in a
+// subdirectory
+func (img *Image) inside(j int, i int) bool {
+	for j > i {
+		p := img.Metadata[j].Parent
+		if p >= j {
+			return false
+		}
+		j = p
+	}
+	return j == i
+}
+
+// lookupIndex returns the metadata index of the clean path p from the path index.
+// A hash match is confirmed by the name of the entry and, recursively, by its parent.
+func (img *Image) lookupIndex(p string) (int, bool) {
+	h := manager.HashPath(p)
+	n := len(img.index) / manager.IndexEntrySize
+	first := sort.Search(n, func(i int) bool {
+		return manager.IndexEntryAt(img.index, i).Hash >= h
+	})
+
+	for k := first; k < n; k++ {
+		ie := manager.IndexEntryAt(img.index, k)
+		if ie.Hash != h {
+			break
+		}
+
+		i := int(ie.Index)
+		if i < 0 || i >= len(img.Metadata) || img.Metadata[i].Name != path.Base(p) {
+			continue
+		}
+		if dir := path.Dir(p); dir == "/" {
+			if ie.Parent == -1 {
+				return i, true
+			}
+		} else if parent, ok := img.lookupIndex(dir); ok && parent == int(ie.Parent) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// Children returns the entries directly below the directory dir, sorted by name if
+// the image stores child tables. Only the entries of dir itself are visited.
+func (img *Image) Children(dir string) []Entry {
+	dir = Clean(dir)
+
+	index := -1
+	if dir != "/" {
+		e, ok := img.Lookup(dir)
+		if !ok || e.Type != manager.Directory {
+			return nil
+		}
+		index = e.Index
+	}
+
+	var children []Entry
+	for _, i := range img.children(index) {
+		m := &img.Metadata[i]
+		children = append(children, Entry{FileMetadata: *m, Index: i, Path: path.Join(dir, m.Name)})
+	}
+	return children
+}
+
+// EntryAt returns the entry at index i of the metadata, reconstructing its path
+// from the parents of the entry
+func (img *Image) EntryAt(i int) (Entry, bool) {
+	if i < 0 || i >= len(img.Metadata) || img.Metadata[i].IsDirEnd() {
+		return Entry{}, false
+	}
+
+	var names []string
+	for j := i; j >= 0; {
+		names = append(names, img.Metadata[j].Name)
+		p := img.Metadata[j].Parent
+		if p >= j {
+			return Entry{}, false
+		}
+		j = p
+	}
+
+	p := ""
+	for k := len(names) - 1; k >= 0; k-- {
+		p += "/" + names[k]
+	}
+	return Entry{FileMetadata: img.Metadata[i], Index: i, Path: p}, true
+}
+
+// Root returns the root directory of the image. The root is not stored in the
+// metadata, so its Index is -1.
+func (img *Image) Root() Entry {
+	return Entry{
+		FileMetadata: manager.FileMetadata{Begin: -1, End: -1, Name: "/", Type: manager.Directory, Mode: os.ModeDir | 0755},
+		Index:        -1,
+		Path:         "/",
+	}
+}
+
+// Resolve returns the entry at p, following symlinks in any component of p.
+// Symlinks are resolved inside the image: absolute targets start at the image root.
+func (img *Image) Resolve(p string) (Entry, error) {
+	e := img.Root()
+	rest := strings.Split(Clean(p)[1:], "/")
+
+	for hops := 0; len(rest) > 0; {
+		name := rest[0]
+		rest = rest[1:]
+		if name == "" {
+			continue
+		}
+
+		next, ok := img.Lookup(path.Join(e.Path, name))
+		if !ok {
+			return Entry{}, fmt.Errorf("%v: no such file or directory", path.Join(e.Path, name))
+		}
+
+		if next.Type == manager.Symlink {
+			if hops++; hops > maxSymlinks {
+				return Entry{}, fmt.Errorf("%v: too many levels of symbolic links", p)
+			}
+			target := next.Link
+			if !path.IsAbs(target) {
+				target = path.Join(e.Path, target)
+			}
+			// Continue from the root with the target followed by the remaining components
+			e = img.Root()
+			rest = append(strings.Split(Clean(target)[1:], "/"), rest...)
+			continue
+		}
+
+		if len(rest) > 0 && next.Type != manager.Directory {
+			return Entry{}, fmt.Errorf("%v: not a directory", next.Path)
+		}
+		e = next
+	}
+
+	return e, nil
+}
+
+// Content returns the data of the regular file m, from the data region or inline
+// in its metadata. The returned slice aliases the image mapping or the metadata and
+// must not be modified or used after Close, unless the file is compressed: then it
+// is decompressed into a new slice. See ReadAt to read parts of large files.
+func (img *Image) Content(m *manager.FileMetadata) ([]byte, error) {
+	stored, err := img.stored(m)
+	if err != nil || m.Codec == "" {
+		return stored, err
+	}
+	if err := checkChunks(m, int64(len(stored))); err != nil {
+		return nil, fmt.Errorf("%v: %v", m.Name, err)
+	}
+
+	data := make([]byte, m.RawSize)
+	if err := img.decompress(m, stored, 0, len(m.Chunks), data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// stored returns the data of the regular file m as stored in the image, inline or
+// in the data region
+func (img *Image) stored(m *manager.FileMetadata) ([]byte, error) {
+	if m.Type != manager.RegularFile {
+		return nil, fmt.Errorf("%v is not a regular file", m.Name)
+	}
+	if m.IsInline() {
+		return m.Inline, nil
+	}
+	if m.Begin < 0 || m.End < m.Begin || m.End > img.HeaderLoc {
+		return nil, fmt.Errorf("data of %v [%v, %v) is outside of the data region", m.Name, m.Begin, m.End)
+	}
+	return img.Data[m.Begin:m.End], nil
+}
+
+// Mappable returns whether the PT_LOAD segments of the ELF file m can be mapped
+// straight out of the image with pages of the given size (a power of two), which
+// holds for the page size it was placed for and any smaller one
+func Mappable(m *manager.FileMetadata, page int64) bool {
+	return m.Type == manager.RegularFile && !m.IsInline() && m.MapPage > 0 && page > 0 && m.MapPage%page == 0
+}
+
+// Clean returns the canonical form of an image path: absolute, without a trailing slash
+func Clean(p string) string {
+	return path.Clean("/" + p)
+}
+
+// readLoc reads the location written by FileWriter.WriteInt64 that ends at end
+func readLoc(data []byte, end int64) (int64, error) {
+	if end < locSize || end > int64(len(data)) {
+		return 0, errors.New("image too small")
+	}
+
+	n, err := binary.ReadVarint(bytes.NewReader(data[end-locSize : end]))
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 || n > end-locSize {
+		return 0, fmt.Errorf("location %v out of range", n)
+	}
+
+	return n, nil
+}
+
+// decodeSection decodes a base64 encoded gob section of the image into v
+func decodeSection(data []byte, v interface{}) error {
+	by, err := base64.StdEncoding.DecodeString(string(data))
+	if err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(by)).Decode(v)
+}
+
+// decodeCompressedSection decodes a gob section of the image compressed with the
+// codec name into v, where size is the size of the gob encoding. Sections are
+// maxDecompressed returns the largest size n bytes compressed with the codec c
+// can decompress to, maxSectionSize if c is not codec.Bounded
+func maxDecompressed(c codec.Codec, n int64) int64 {
+	if b, ok := c.(codec.Bounded); ok {
+		return n * b.MaxRatio()
+	}
+	return maxSectionSize
+}
+
+// base64 encoded instead if name is "".
+func decodeCompressedSection(data []byte, name string, size int64, v interface{}) error {
+	if name == "" {
+		return decodeSection(data, v)
+	}
+
+	c, err := codec.Get(name)
+	if err != nil {
+		return err
+	}
+	// Sizes the compressed data can't decompress to are rejected before allocating
+	if size < 0 || size > maxDecompressed(c, int64(len(data))) {
+		return fmt.Errorf("section size %v out of range for %v compressed bytes", size, len(data))
+	}
+	by := make([]byte, size)
+	if err := c.Decompress(by, data); err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(by)).Decode(v)
+}
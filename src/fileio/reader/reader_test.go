@@ -0,0 +1,1002 @@
+package reader_test
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+
+	"fileio/reader"
+	"manager"
+	"policy"
+	"stats"
+)
+
+// buildImage writes the files (path -> content) into a temporary dir and creates
+// an image from it the same way writeImage in main.go does. The caller removes dir.
+func buildImage(t *testing.T, files map[string]string, align int64) (img string, dir string) {
+	return buildImageWith(t, files, &manager.ZarManager{
+		Alignment:  align,
+		Statistics: &stats.ImgStats{},
+	})
+}
+
+// buildImageWith is buildImage with the layout of the manager z
+func buildImageWith(t *testing.T, files map[string]string, z *manager.ZarManager) (img string, dir string) {
+	dir, err := ioutil.TempDir("", "zar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := filepath.Join(dir, "root")
+	for p, content := range files {
+		fn := filepath.Join(root, p)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	img = filepath.Join(dir, "test.img")
+	writeImage(z, root, img)
+	return img, dir
+}
+
+// writeImage creates the image fn from the dir root with the layout of z
+func writeImage(z *manager.ZarManager, root string, fn string) {
+	z.Writer.Init(fn)
+	z.WalkDir(root, root, 0, 0, true)
+	z.GenerateFilter()
+	z.WriteHeader()
+}
+
+func TestOpen(t *testing.T) {
+	fn, dir := buildImage(t, map[string]string{
+		"Apples.txt":             "apples",
+		"Groceries/Bananas.txt":  "bananas",
+		"Groceries/Sub/Figs.txt": "figs",
+	}, 4096)
+	defer os.RemoveAll(dir)
+
+	img, err := reader.Open(fn)
+	if err != nil {
+		t.Fatalf("reader.Open(%v) failed: %v", fn, err)
+	}
+	defer img.Close()
+
+	var paths []string
+	for _, e := range img.Entries() {
+		paths = append(paths, e.Path)
+	}
+	exp := []string{"/Apples.txt", "/Groceries", "/Groceries/Bananas.txt", "/Groceries/Sub", "/Groceries/Sub/Figs.txt"}
+	if len(paths) != len(exp) {
+		t.Fatalf("img.Entries() paths = %v, expected %v", paths, exp)
+	}
+	for i := range exp {
+		if paths[i] != exp[i] {
+			t.Errorf("img.Entries()[%d].Path = %v, expected %v", i, paths[i], exp[i])
+		}
+	}
+
+	e, ok := img.Stat("Groceries/Bananas.txt")
+	if !ok {
+		t.Fatalf("img.Stat(Groceries/Bananas.txt) not found")
+	}
+	content, err := img.Content(&e.FileMetadata)
+	if err != nil || string(content) != "bananas" {
+		t.Errorf("img.Content(Bananas.txt) = %q, %v, expected \"bananas\"", content, err)
+	}
+	if e.Begin%4096 != 0 {
+		t.Errorf("Bananas.txt begins at %v, expected page aligned", e.Begin)
+	}
+
+	children := img.Children("/Groceries")
+	if len(children) != 2 || children[0].Name != "Bananas.txt" || children[1].Name != "Sub" {
+		t.Errorf("img.Children(/Groceries) = %v, expected [Bananas.txt Sub]", children)
+	}
+
+	if !img.Filter.TestElement([]byte("/Groceries/Sub/Figs.txt")) {
+		t.Errorf("img.Filter.TestElement(/Groceries/Sub/Figs.txt) returned false")
+	}
+}
+
+func TestAlignment(t *testing.T) {
+	for _, align := range []int64{512, 16384, 65536} {
+		fn, dir := buildImage(t, map[string]string{
+			"Apples.txt":            "apples",
+			"Groceries/Bananas.txt": "bananas",
+			"Oranges.txt":           "oranges",
+		}, align)
+		defer os.RemoveAll(dir)
+
+		img, err := reader.Open(fn)
+		if err != nil {
+			t.Fatalf("reader.Open(%v) failed: %v", fn, err)
+		}
+		defer img.Close()
+
+		if img.Footer.Alignment != align {
+			t.Errorf("Footer.Alignment = %v, expected %v", img.Footer.Alignment, align)
+		}
+		for _, e := range img.Entries() {
+			if e.Type == manager.RegularFile && e.Begin%align != 0 {
+				t.Errorf("%v begins at %v, expected aligned to %v", e.Path, e.Begin, align)
+			}
+		}
+		if problems := img.Verify(); len(problems) != 0 {
+			t.Errorf("img.Verify() of an image aligned to %v = %v, expected no problems", align, problems)
+		}
+
+		img.Footer.Alignment = align + 1
+		if problems := img.Verify(); len(problems) == 0 || !strings.Contains(problems[0].String(), "not a power of two") {
+			t.Errorf("img.Verify() with alignment %v = %v, expected it to be rejected", align+1, problems)
+		}
+	}
+}
+
+func TestPackSmall(t *testing.T) {
+	files := map[string]string{
+		"Apples.txt":            "apples",
+		"Cherries.txt":          "cherries",
+		"Groceries/Bananas.txt": strings.Repeat("bananas ", 100),
+		"Oranges.txt":           strings.Repeat("oranges ", 100),
+	}
+	z := &manager.ZarManager{Alignment: 4096, PackThreshold: 64, Statistics: &stats.ImgStats{}}
+	fn, dir := buildImageWith(t, files, z)
+	defer os.RemoveAll(dir)
+
+	img, err := reader.Open(fn)
+	if err != nil {
+		t.Fatalf("reader.Open(%v) failed: %v", fn, err)
+	}
+	defer img.Close()
+
+	if img.Footer.PackThreshold != 64 {
+		t.Errorf("Footer.PackThreshold = %v, expected 64", img.Footer.PackThreshold)
+	}
+	for _, e := range img.Entries() {
+		if e.Type != manager.RegularFile {
+			continue
+		}
+		content, err := img.Content(&e.FileMetadata)
+		if err != nil || string(content) != files[e.Path[1:]] {
+			t.Errorf("img.Content(%v) = %q, %v, expected %q", e.Path, content, err, files[e.Path[1:]])
+		}
+		if e.Size() >= 64 && e.Begin%4096 != 0 {
+			t.Errorf("%v begins at %v, expected page aligned", e.Path, e.Begin)
+		}
+	}
+	if c, _ := img.Lookup("/Cherries.txt"); c.Begin%4096 == 0 {
+		t.Errorf("Cherries.txt begins at %v, expected packed behind Apples.txt", c.Begin)
+	}
+	if problems := img.Verify(); len(problems) != 0 {
+		t.Errorf("img.Verify() = %v, expected no problems", problems)
+	}
+
+	// The two small files share one page; the large files stay in their own pages
+	if z.Statistics.NumPacked != 2 || z.Statistics.PackedSaved() != 4096 {
+		t.Errorf("%v packed files saved %v bytes, expected 2 files and 4096 bytes",
+			z.Statistics.NumPacked, z.Statistics.PackedSaved())
+	}
+}
+
+func TestAlignPolicy(t *testing.T) {
+	files := map[string]string{
+		"Apples.txt":      "apples",
+		"lib/libfruit.so": "not really a library",
+		"bin/peel":        "\x7fELF peeler",
+		"Oranges.txt":     "oranges",
+	}
+	rules, err := policy.Parse(strings.NewReader("page magic=elf\npage glob=*.so\nnone"), 4096)
+	if err != nil {
+		t.Fatalf("policy.Parse failed: %v", err)
+	}
+	fn, dir := buildImageWith(t, files, &manager.ZarManager{Policy: rules, Statistics: &stats.ImgStats{}})
+	defer os.RemoveAll(dir)
+
+	img, err := reader.Open(fn)
+	if err != nil {
+		t.Fatalf("reader.Open(%v) failed: %v", fn, err)
+	}
+	defer img.Close()
+
+	for p, align := range map[string]int64{"/Apples.txt": 0, "/lib/libfruit.so": 4096, "/bin/peel": 4096, "/Oranges.txt": 0} {
+		e, _ := img.Lookup(p)
+		if e.Align != align {
+			t.Errorf("%v has alignment %v, expected %v", p, e.Align, align)
+		}
+		if align > 0 && e.Begin%align != 0 {
+			t.Errorf("%v begins at %v, expected aligned to %v", p, e.Begin, align)
+		}
+	}
+	if problems := img.Verify(); len(problems) != 0 {
+		t.Errorf("img.Verify() = %v, expected no problems", problems)
+	}
+
+	peel, _ := img.Lookup("/bin/peel")
+	img.Metadata[peel.Index].Begin++
+	if problems := img.Verify(); len(problems) == 0 || !strings.Contains(problems[0].String(), "not aligned to 4096") {
+		t.Errorf("img.Verify() of a misaligned file = %v, expected it to be reported", problems)
+	}
+}
+
+func TestDedupPlacement(t *testing.T) {
+	files := map[string]string{
+		"Apples.txt":      "apples",
+		"Pears.txt":       "apples",
+		"lib/apples.so":   "apples",
+		"lib/libfruit.so": "apples",
+	}
+	rules, err := policy.Parse(strings.NewReader("page glob=*.so"), 4096)
+	if err != nil {
+		t.Fatalf("policy.Parse failed: %v", err)
+	}
+	for _, workers := range []int{0, 4} {
+		fn, dir := buildImageWith(t, files, &manager.ZarManager{
+			Alignment:     4096,
+			PackThreshold: 100,
+			Policy:        rules,
+			Dedup:         true,
+			Workers:       workers,
+			Statistics:    &stats.ImgStats{},
+		})
+		defer os.RemoveAll(dir)
+
+		img, err := reader.Open(fn)
+		if err != nil {
+			t.Fatalf("reader.Open(%v) failed: %v", fn, err)
+		}
+		defer img.Close()
+
+		// Packed and aligned copies of the same content don't share an extent
+		apples, _ := img.Lookup("/Apples.txt")
+		pears, _ := img.Lookup("/Pears.txt")
+		so, _ := img.Lookup("/lib/apples.so")
+		lib, _ := img.Lookup("/lib/libfruit.so")
+		if apples.Begin != pears.Begin || so.Begin != lib.Begin || apples.Begin == so.Begin {
+			t.Errorf("with %v workers Apples.txt, Pears.txt, lib/apples.so and lib/libfruit.so begin at %v, %v, %v, %v, expected the .txt and the .so files to share one extent each",
+				workers, apples.Begin, pears.Begin, so.Begin, lib.Begin)
+		}
+		for _, e := range []reader.Entry{so, lib} {
+			if e.Align != 4096 || e.Begin%4096 != 0 {
+				t.Errorf("with %v workers %v has alignment %v at %v, expected 4096", workers, e.Path, e.Align, e.Begin)
+			}
+		}
+		if problems := img.Verify(); len(problems) != 0 {
+			t.Errorf("img.Verify() with %v workers = %v, expected no problems", workers, problems)
+		}
+	}
+}
+
+// makeELF returns a little endian ELF64 executable with a PT_LOAD segment for
+// each {offset, vaddr} of loads
+func makeELF(loads [][2]uint64) string {
+	b := make([]byte, 0x2000)
+	copy(b, "\x7fELF\x02\x01\x01")
+	le := binary.LittleEndian
+	le.PutUint16(b[16:], uint16(elf.ET_EXEC))
+	le.PutUint16(b[18:], uint16(elf.EM_X86_64))
+	le.PutUint32(b[20:], uint32(elf.EV_CURRENT))
+	le.PutUint64(b[32:], 64) // e_phoff
+	le.PutUint16(b[52:], 64) // e_ehsize
+	le.PutUint16(b[54:], 56) // e_phentsize
+	le.PutUint16(b[56:], uint16(len(loads)))
+	for i, l := range loads {
+		ph := b[64+56*i:]
+		le.PutUint32(ph, uint32(elf.PT_LOAD))
+		le.PutUint64(ph[8:], l[0])   // p_offset
+		le.PutUint64(ph[16:], l[1])  // p_vaddr
+		le.PutUint64(ph[32:], 0x100) // p_filesz
+		le.PutUint64(ph[40:], 0x100) // p_memsz
+		le.PutUint64(ph[48:], 0x1000)
+	}
+	return string(b)
+}
+
+func TestELFPlacement(t *testing.T) {
+	files := map[string]string{
+		"Apples.txt":   "apples",
+		"bin/peel":     makeELF([][2]uint64{{0x100, 0x400300}, {0x1100, 0x402300}}),
+		"bin/broken":   makeELF([][2]uint64{{0, 0x400000}, {0x1100, 0x402300}}),
+		"lib/fruit.so": makeELF([][2]uint64{{0, 0}, {0x1100, 0x2100}}),
+	}
+	fn, dir := buildImageWith(t, files, &manager.ZarManager{ELFPage: 4096, Statistics: &stats.ImgStats{}})
+	defer os.RemoveAll(dir)
+
+	img, err := reader.Open(fn)
+	if err != nil {
+		t.Fatalf("reader.Open(%v) failed: %v", fn, err)
+	}
+	defer img.Close()
+
+	for p, residue := range map[string]int64{"/bin/peel": 0x200, "/lib/fruit.so": 0, "/bin/broken": -1, "/Apples.txt": -1} {
+		e, _ := img.Lookup(p)
+		if residue < 0 {
+			if e.MapPage != 0 || reader.Mappable(&e.FileMetadata, 4096) {
+				t.Errorf("%v is marked for mapping with pages of %v", p, e.MapPage)
+			}
+			continue
+		}
+		if e.MapPage != 4096 || e.Begin%4096 != residue {
+			t.Errorf("%v begins at %v placed for pages of %v, expected %#x modulo 4096", p, e.Begin, e.MapPage, residue)
+		}
+		if !reader.Mappable(&e.FileMetadata, 4096) || !reader.Mappable(&e.FileMetadata, 512) || reader.Mappable(&e.FileMetadata, 16384) {
+			t.Errorf("%v is mappable with pages of %v, expected 4096 and smaller", p, e.MapPage)
+		}
+		content, err := img.Content(&e.FileMetadata)
+		if err != nil || string(content) != files[p[1:]] {
+			t.Errorf("img.Content(%v) is not the file written, err %v", p, err)
+		}
+	}
+	if problems := img.Verify(); len(problems) != 0 {
+		t.Errorf("img.Verify() = %v, expected no problems", problems)
+	}
+
+	broken, _ := img.Lookup("/bin/broken")
+	img.Metadata[broken.Index].MapPage = 4096
+	if problems := img.Verify(); len(problems) != 1 || !strings.Contains(problems[0].String(), "segments can't be mapped") {
+		t.Errorf("img.Verify() with an ELF file wrongly marked = %v, expected it to be reported", problems)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	text := ""
+	for i := 0; len(text) < 10000; i++ {
+		text += fmt.Sprintf("line %v of the grocery list\n", i)
+	}
+	files := map[string]string{
+		"Groceries.txt": text,
+		"Picture.png":   "\x89PNG" + strings.Repeat("x", 1000),
+		"Apples.txt":    "apples",
+	}
+	fn, dir := buildImageWith(t, files, &manager.ZarManager{
+		Compression: "flate",
+		ChunkSize:   1024,
+		Statistics:  &stats.ImgStats{},
+	})
+	defer os.RemoveAll(dir)
+
+	img, err := reader.Open(fn)
+	if err != nil {
+		t.Fatalf("reader.Open(%v) failed: %v", fn, err)
+	}
+	defer img.Close()
+
+	for p, codec := range map[string]string{"/Groceries.txt": "flate", "/Picture.png": "", "/Apples.txt": ""} {
+		e, _ := img.Lookup(p)
+		if e.Codec != codec {
+			t.Errorf("%v is compressed with %q, expected %q", p, e.Codec, codec)
+		}
+		if e.Size() != int64(len(files[p[1:]])) {
+			t.Errorf("%v has size %v, expected %v", p, e.Size(), len(files[p[1:]]))
+		}
+		if content, err := img.Content(&e.FileMetadata); err != nil || string(content) != files[p[1:]] {
+			t.Errorf("img.Content(%v) is not the file written, err %v", p, err)
+		}
+		if content, err := ioutil.ReadAll(img.NewReader(&e.FileMetadata)); err != nil || string(content) != files[p[1:]] {
+			t.Errorf("reading %v with img.NewReader is not the file written, err %v", p, err)
+		}
+	}
+
+	e, _ := img.Lookup("/Groceries.txt")
+	if len(e.Chunks) != (len(text)+1023)/1024 || e.End-e.Begin >= int64(len(text)) {
+		t.Errorf("Groceries.txt is stored in %v bytes and %v chunks", e.End-e.Begin, len(e.Chunks))
+	}
+	for _, r := range [][2]int{{0, 10}, {1000, 100}, {1020, 2000}, {len(text) - 5, 5}, {len(text) - 5, 100}} {
+		p := make([]byte, r[1])
+		n, err := img.ReadAt(&e.FileMetadata, p, int64(r[0]))
+		end := r[0] + r[1]
+		if end > len(text) {
+			end = len(text)
+		}
+		if string(p[:n]) != text[r[0]:end] || (end < r[0]+r[1]) != (err == io.EOF) {
+			t.Errorf("img.ReadAt(Groceries.txt, %v bytes at %v) = %q, %v, expected %q", r[1], r[0], p[:n], err, text[r[0]:end])
+		}
+	}
+	if problems := img.Verify(); len(problems) != 0 {
+		t.Errorf("img.Verify() = %v, expected no problems", problems)
+	}
+
+	img.Metadata[e.Index].Chunks = e.Chunks[1:]
+	if problems := img.Verify(); len(problems) != 1 || !strings.Contains(problems[0].String(), "can't decompress") {
+		t.Errorf("img.Verify() with a truncated chunk table = %v, expected it to be reported", problems)
+	}
+
+	// Corrupt chunk tables are rejected before anything is divided or allocated
+	for _, corrupt := range []func(m *manager.FileMetadata){
+		func(m *manager.FileMetadata) { m.ChunkSize = 0 },
+		func(m *manager.FileMetadata) { m.ChunkSize = -1 },
+		func(m *manager.FileMetadata) { m.ChunkSize = 1 << 62 },
+		func(m *manager.FileMetadata) { m.RawSize = 1 << 50 },
+		func(m *manager.FileMetadata) { m.RawSize, m.ChunkSize = 1<<50, 1<<40 },
+		func(m *manager.FileMetadata) { m.RawSize = -1 },
+	} {
+		m := e.FileMetadata
+		corrupt(&m)
+		if _, err := img.ReadAt(&m, make([]byte, 10), 0); err == nil {
+			t.Errorf("img.ReadAt of Groceries.txt with size %v in chunks of %v succeeded", m.RawSize, m.ChunkSize)
+		}
+		if _, err := img.Content(&m); err == nil {
+			t.Errorf("img.Content of Groceries.txt with size %v in chunks of %v succeeded", m.RawSize, m.ChunkSize)
+		}
+	}
+}
+
+func TestCompressedSections(t *testing.T) {
+	files := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		files[fmt.Sprintf("Groceries/Item%03d.txt", i)] = fmt.Sprintf("item %v", i)
+	}
+	fn, dir := buildImageWith(t, files, &manager.ZarManager{
+		Alignment:    4096,
+		SectionCodec: "gzip",
+		Statistics:   &stats.ImgStats{},
+	})
+	defer os.RemoveAll(dir)
+
+	// The same files without compressed sections
+	plainFn := filepath.Join(dir, "plain.img")
+	writeImage(&manager.ZarManager{Alignment: 4096, Statistics: &stats.ImgStats{}}, filepath.Join(dir, "root"), plainFn)
+
+	img, err := reader.Open(fn)
+	if err != nil {
+		t.Fatalf("reader.Open(%v) failed: %v", fn, err)
+	}
+	defer img.Close()
+	plain, err := reader.Open(plainFn)
+	if err != nil {
+		t.Fatalf("reader.Open(%v) failed: %v", plainFn, err)
+	}
+	defer plain.Close()
+
+	if img.Footer.SectionCodec != "gzip" || plain.Footer.SectionCodec != "" {
+		t.Errorf("section codecs are %q and %q, expected gzip and none", img.Footer.SectionCodec, plain.Footer.SectionCodec)
+	}
+	if !reflect.DeepEqual(img.Metadata, plain.Metadata) || !reflect.DeepEqual(img.Filter, plain.Filter) {
+		t.Errorf("metadata or filter decoded from compressed sections differ from the plain image")
+	}
+	if img.HeaderLoc != plain.HeaderLoc {
+		t.Errorf("data region ends at %v, expected %v as in the plain image", img.HeaderLoc, plain.HeaderLoc)
+	}
+	size := func(img *reader.Image) int64 { return img.FooterLoc - img.HeaderLoc }
+	if size(img) >= size(plain) {
+		t.Errorf("compressed sections take %v bytes, plain ones %v", size(img), size(plain))
+	}
+
+	e, ok := img.Lookup("/Groceries/Item042.txt")
+	if content, err := img.Content(&e.FileMetadata); !ok || err != nil || string(content) != "item 42" {
+		t.Errorf("img.Content(/Groceries/Item042.txt) = %q, %v, expected %q", content, err, "item 42")
+	}
+	if problems := img.Verify(); len(problems) != 0 {
+		t.Errorf("img.Verify() = %v, expected no problems", problems)
+	}
+
+	// A corrupt footer can't claim sizes the sections can't decompress to
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The metadata section ends with the location of the metadata before the filter
+	stored := img.FilterMetadata.FilterLoc - binary.MaxVarintLen64 - img.HeaderLoc
+	for _, size := range []int64{-1, stored*1032 + 1, 1 << 40} {
+		footer := img.Footer
+		footer.MetadataSize = size
+		if _, err := reader.Decode(withFooter(t, data[:img.FooterLoc], footer)); err == nil || !strings.Contains(err.Error(), "out of range") {
+			t.Errorf("reader.Decode with metadata size %v = %v, expected the size to be out of range", size, err)
+		}
+	}
+	footer := img.Footer
+	footer.MetadataSize++
+	if _, err := reader.Decode(withFooter(t, data[:img.FooterLoc], footer)); err == nil {
+		t.Errorf("reader.Decode with metadata size %v succeeded", footer.MetadataSize)
+	}
+	if _, err := reader.Decode(withFooter(t, data[:img.FooterLoc], img.Footer)); err != nil {
+		t.Errorf("reader.Decode with the footer rewritten failed: %v", err)
+	}
+}
+
+// withFooter returns the image data up to the footer followed by footer, encoded
+// as WriteHeader does. The footer is a manager.Footer, or a filter.FilterMetadata
+// as in images written before the footer existed.
+func withFooter(t *testing.T, data []byte, footer interface{}) []byte {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(footer); err != nil {
+		t.Fatal(err)
+	}
+	loc := make([]byte, binary.MaxVarintLen64)
+	binary.PutVarint(loc, int64(len(data)))
+
+	out := append([]byte{}, data...)
+	out = append(out, base64.StdEncoding.EncodeToString(b.Bytes())...)
+	return append(out, loc...)
+}
+
+// patternReader is an io.ReaderAt of size bytes of a pattern that does not compress
+// well, generated as it is read
+type patternReader struct {
+	size int64
+}
+
+func (p patternReader) ReadAt(b []byte, off int64) (int, error) {
+	n := 0
+	for ; n < len(b) && off+int64(n) < p.size; n++ {
+		i := off + int64(n)
+		b[n] = byte(i*i>>7 ^ i)
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func TestStreaming(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The big files are aligned so they are not compressed, the others are packed
+	fn := filepath.Join(dir, "test.img")
+	z := &manager.ZarManager{
+		Policy: manager.AlignPolicyFunc(func(p string, size int64, head []byte) (int64, bool) {
+			return 4096, strings.HasSuffix(p, ".bin")
+		}),
+		Compression: "flate",
+		ChunkSize:   4096,
+		Checksum:    true,
+		Dedup:       true,
+		Statistics:  &stats.ImgStats{},
+	}
+	z.Writer.Init(fn)
+
+	text := strings.Repeat("streamed into the image\n", 1000)
+	big := patternReader{size: 64 << 20}
+	noise := patternReader{size: 20000}
+	files := []struct {
+		name string
+		r    io.ReaderAt
+		size int64
+	}{
+		{"text.txt", strings.NewReader(text), int64(len(text))},
+		{"big.bin", big, big.size},
+		{"copy.bin", big, big.size},
+		{"noise.dat", noise, noise.size},
+		{"empty", strings.NewReader(""), 0},
+	}
+
+	for _, f := range files {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		h, err := z.WriteData("/"+f.name, f.r, f.size)
+		if err != nil {
+			t.Fatalf("z.WriteData(%v) failed: %v", f.name, err)
+		}
+		runtime.ReadMemStats(&after)
+		if alloc := after.TotalAlloc - before.TotalAlloc; f.r == big && alloc > 1<<20 {
+			t.Errorf("writing %v (%v bytes) allocated %v bytes, expected the memory to be bounded", f.name, f.size, alloc)
+		}
+		h.Name = f.name
+		z.IncludeFileMetadata(h)
+	}
+	z.GenerateFilter()
+	z.WriteHeader()
+
+	img, err := reader.Open(fn)
+	if err != nil {
+		t.Fatalf("reader.Open(%v) failed: %v", fn, err)
+	}
+	defer img.Close()
+
+	e, _ := img.Lookup("/text.txt")
+	if content, err := img.Content(&e.FileMetadata); err != nil || string(content) != text || e.Codec != "flate" {
+		t.Errorf("text.txt is not the text written compressed, codec %q, err %v", e.Codec, err)
+	}
+	n, _ := img.Lookup("/noise.dat")
+	if n.Codec != "" || n.End-n.Begin != noise.size {
+		t.Errorf("noise.dat is stored in %v bytes with codec %q, expected it as is", n.End-n.Begin, n.Codec)
+	}
+	b, _ := img.Lookup("/big.bin")
+	c, _ := img.Lookup("/copy.bin")
+	if b.Begin != c.Begin || b.End != c.End {
+		t.Errorf("big.bin [%v, %v) and copy.bin [%v, %v) don't share their data", b.Begin, b.End, c.Begin, c.End)
+	}
+	if n.Begin != b.End {
+		t.Errorf("noise.dat begins at %v, expected %v right after the only copy of big.bin", n.Begin, b.End)
+	}
+	if problems := img.Verify(); len(problems) != 0 {
+		t.Errorf("img.Verify() = %v, expected no problems", problems)
+	}
+
+	if _, err := z.WriteData("/short", patternReader{size: 100}, 200); err == nil {
+		t.Errorf("z.WriteData with less data than its size succeeded")
+	}
+}
+
+func TestTwoPass(t *testing.T) {
+	files := map[string]string{
+		"Apples.txt":            "apples",
+		"Groceries/Bananas.txt": strings.Repeat("bananas\n", 10000),
+		"Groceries/Dup.txt":     strings.Repeat("bananas\n", 10000),
+		"Groceries/List.txt":    strings.Repeat("cherries\n", 1000),
+		"Empty":                 "",
+	}
+	for _, layout := range []manager.ZarManager{
+		{Alignment: 65536},
+		{Alignment: 65536, PackThreshold: 1000, Dedup: true, Checksum: true},
+		{Compression: "flate", Dedup: true, InlineLimit: 10},
+	} {
+		z := layout
+		z.Statistics = &stats.ImgStats{}
+		fn, dir := buildImageWith(t, files, &z)
+		defer os.RemoveAll(dir)
+
+		want, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		twoPassFn := filepath.Join(dir, "twopass.img")
+		for _, workers := range []int{0, 4} {
+			z = layout
+			z.Statistics = &stats.ImgStats{}
+			z.Writer.Deferred = true
+			z.Workers = workers
+			writeImage(&z, filepath.Join(dir, "root"), twoPassFn)
+
+			got, err := ioutil.ReadFile(twoPassFn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("image written in two passes with %+v and %v workers differs from the one written in one", layout, workers)
+			}
+		}
+
+		// Padding is a hole, on file systems that support them
+		var st, twoPassSt syscall.Stat_t
+		if syscall.Stat(fn, &st) == nil && syscall.Stat(twoPassFn, &twoPassSt) == nil && twoPassSt.Blocks > st.Blocks {
+			t.Errorf("image written in two passes with %+v takes %v blocks, more than the %v of the one written in one",
+				layout, twoPassSt.Blocks, st.Blocks)
+		}
+	}
+
+	// Files that change size between the passes fail the copy, also when read by
+	// workers in the first pass
+	for _, workers := range []int{0, 4} {
+		fn, dir := buildImage(t, files, 4096)
+		defer os.RemoveAll(dir)
+
+		root := filepath.Join(dir, "root")
+		z := &manager.ZarManager{Alignment: 4096, Workers: workers, Statistics: &stats.ImgStats{}}
+		z.Writer.Deferred = true
+		z.Writer.Init(fn)
+		z.WalkDir(root, root, 0, 0, true)
+
+		f, err := os.OpenFile(filepath.Join(root, "Groceries", "List.txt"), os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString("dates\n")
+		f.Close()
+		if err := z.Writer.Close(); err == nil || !strings.Contains(err.Error(), "file changed") {
+			t.Errorf("closing a two pass image with %v workers after a file grew = %v, expected it to fail", workers, err)
+		}
+	}
+
+}
+
+func TestParallelWalk(t *testing.T) {
+	files := map[string]string{
+		"Apples.txt":                 "apples",
+		"Groceries/Bananas.txt":      strings.Repeat("bananas\n", 10000),
+		"Groceries/Dup.txt":          strings.Repeat("bananas\n", 10000),
+		"Groceries/Fruit/Kiwi.txt":   "kiwi",
+		"Groceries/Fruit/Lemons.txt": strings.Repeat("lemons\n", 200000),
+		"Picture.png":                "\x89PNG" + strings.Repeat("x", 1000),
+		"Empty":                      "",
+	}
+	for i := 0; i < 50; i++ {
+		files[fmt.Sprintf("Groceries/Items/Item%02d.txt", i)] = fmt.Sprintf("item %v\n", i)
+	}
+	for _, layout := range []manager.ZarManager{
+		{},
+		{Alignment: 4096, PackThreshold: 1000, Dedup: true, Checksum: true},
+		{Compression: "flate", ChunkSize: 4096, Dedup: true, InlineLimit: 10, KeepOrder: true},
+	} {
+		z := layout
+		z.Statistics = &stats.ImgStats{}
+		fn, dir := buildImageWith(t, files, &z)
+		defer os.RemoveAll(dir)
+
+		root := filepath.Join(dir, "root")
+		if err := os.Symlink("Apples.txt", filepath.Join(root, "link")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Link(filepath.Join(root, "Apples.txt"), filepath.Join(root, "Groceries", "Apples.txt")); err != nil {
+			t.Fatal(err)
+		}
+		z = layout
+		z.Statistics = &stats.ImgStats{}
+		writeImage(&z, root, fn)
+
+		want, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, workers := range []int{2, 8} {
+			z := layout
+			z.Statistics = &stats.ImgStats{}
+			z.Workers = workers
+			parallelFn := filepath.Join(dir, fmt.Sprintf("parallel%v.img", workers))
+			writeImage(&z, root, parallelFn)
+
+			got, err := ioutil.ReadFile(parallelFn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("image written with %+v and %v workers differs from the one written serially", layout, workers)
+			}
+		}
+	}
+}
+
+// BenchmarkWrite compares writing an image in one pass through the buffer of the
+// writer, in two passes copying the data with copy_file_range and with files read
+// by parallel workers
+func BenchmarkWrite(b *testing.B) {
+	dir, err := ioutil.TempDir("", "zar")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "root")
+	content := make([]byte, 4<<20)
+	patternReader{size: int64(len(content))}.ReadAt(content, 0)
+	for i := 0; i < 16; i++ {
+		fn := filepath.Join(root, fmt.Sprintf("dir%v", i%4), fmt.Sprintf("file%v.bin", i))
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			b.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, content[:len(content)>>uint(i%8)], 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, bench := range []struct {
+		name     string
+		deferred bool
+		workers  int
+	}{
+		{"OnePass", false, 0},
+		{"TwoPass", true, 0},
+		{"Parallel", false, 8},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			stdout := os.Stdout
+			os.Stdout, _ = os.Open(os.DevNull)
+			defer func() { os.Stdout = stdout }()
+
+			for i := 0; i < b.N; i++ {
+				z := &manager.ZarManager{Alignment: 4096, Statistics: &stats.ImgStats{}}
+				z.Writer.Deferred = bench.deferred
+				z.Workers = bench.workers
+				writeImage(z, root, filepath.Join(dir, "test.img"))
+			}
+		})
+	}
+}
+
+func TestInline(t *testing.T) {
+	files := map[string]string{
+		"Apples.txt":            "apples",
+		"Empty":                 "",
+		"Groceries/Bananas.txt": "bananas",
+		"Oranges.txt":           strings.Repeat("oranges ", 100),
+	}
+	fn, dir := buildImageWith(t, files, &manager.ZarManager{
+		Alignment:   4096,
+		InlineLimit: 16,
+		Statistics:  &stats.ImgStats{},
+	})
+	defer os.RemoveAll(dir)
+
+	img, err := reader.Open(fn)
+	if err != nil {
+		t.Fatalf("reader.Open(%v) failed: %v", fn, err)
+	}
+	defer img.Close()
+
+	for p, content := range files {
+		e, ok := img.Lookup("/" + p)
+		if !ok {
+			t.Fatalf("img.Lookup(/%v) not found", p)
+		}
+		got, err := img.Content(&e.FileMetadata)
+		if err != nil || string(got) != content {
+			t.Errorf("img.Content(/%v) = %q, %v, expected %q", p, got, err, content)
+		}
+		if e.Size() != int64(len(content)) {
+			t.Errorf("/%v has size %v, expected %v", p, e.Size(), len(content))
+		}
+		if inline := len(content) <= 16; e.IsInline() != inline {
+			t.Errorf("/%v inline = %v, expected %v", p, e.IsInline(), inline)
+		}
+	}
+	if oranges, _ := img.Lookup("/Oranges.txt"); oranges.Begin != 0 {
+		t.Errorf("Oranges.txt begins at %v, expected 0 as the only file in the data region", oranges.Begin)
+	}
+	if problems := img.Verify(); len(problems) != 0 {
+		t.Errorf("img.Verify() = %v, expected no problems", problems)
+	}
+
+	img.Footer.InlineLimit = 4
+	if problems := img.Verify(); len(problems) != 2 || !strings.Contains(problems[0].String(), "exceeds the limit") {
+		t.Errorf("img.Verify() with inline limit 4 = %v, expected Apples.txt and Bananas.txt to exceed it", problems)
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	if _, err := reader.Decode([]byte("not an image")); err == nil {
+		t.Errorf("reader.Decode of garbage succeeded")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	fn, dir := buildImage(t, map[string]string{
+		"Apples.txt":             "apples",
+		"Groceries/Apples.txt":   "more apples",
+		"Groceries/Bananas.txt":  "bananas",
+		"Groceries/Sub/Figs.txt": "figs",
+	}, 0)
+	defer os.RemoveAll(dir)
+
+	img, err := reader.Open(fn)
+	if err != nil {
+		t.Fatalf("reader.Open(%v) failed: %v", fn, err)
+	}
+	defer img.Close()
+
+	if img.Footer.IndexSize == 0 {
+		t.Fatalf("image has no path index")
+	}
+
+	for _, e := range img.Entries() {
+		found, ok := img.Lookup(e.Path)
+		if !ok || found.Index != e.Index || found.Path != e.Path || found.Name != e.Name {
+			t.Errorf("img.Lookup(%v) = %+v, %v, expected entry %d", e.Path, found, ok, e.Index)
+		}
+	}
+
+	// Lookup accepts the same unclean paths as Stat
+	if e, ok := img.Lookup("Groceries//Sub/../Apples.txt/"); !ok || e.Path != "/Groceries/Apples.txt" {
+		t.Errorf("img.Lookup(Groceries//Sub/../Apples.txt/) = %+v, %v", e, ok)
+	}
+
+	for _, p := range []string{"/", "/Oranges.txt", "/Groceries/Figs.txt", "/Apples.txt/x", "/Sub/Figs.txt"} {
+		if e, ok := img.Lookup(p); ok {
+			t.Errorf("img.Lookup(%v) = %+v, expected not found", p, e)
+		}
+	}
+}
+
+func TestSkipPointers(t *testing.T) {
+	fn, dir := buildImage(t, map[string]string{
+		"Apples.txt":             "apples",
+		"Groceries/Bananas.txt":  "bananas",
+		"Groceries/Sub/Figs.txt": "figs",
+		"Groceries/Sub/Kiwi.txt": "kiwi",
+		"Oranges.txt":            "oranges",
+	}, 0)
+	defer os.RemoveAll(dir)
+
+	img, err := reader.Open(fn)
+	if err != nil {
+		t.Fatalf("reader.Open(%v) failed: %v", fn, err)
+	}
+	defer img.Close()
+
+	// Both subtrees end right before /Oranges.txt
+	oranges, _ := img.Lookup("/Oranges.txt")
+	for p, n := range map[string]int{"/Groceries": 2, "/Groceries/Sub": 2} {
+		e, _ := img.Lookup(p)
+		if e.NumChildren != n {
+			t.Errorf("%v.NumChildren = %v, expected %v", p, e.NumChildren, n)
+		}
+		if e.SubtreeEnd != oranges.Index {
+			t.Errorf("%v.SubtreeEnd = %v, expected %v", p, e.SubtreeEnd, oranges.Index)
+		}
+	}
+
+	// Images written without skip pointers and child tables are listed the same way
+	listings := func() []string {
+		var names []string
+		for _, d := range []string{"/", "/Groceries", "/Groceries/Sub"} {
+			for _, e := range img.Children(d) {
+				names = append(names, e.Path)
+			}
+		}
+		return names
+	}
+	withPointers := listings()
+	img.Footer.SortedChildren = false
+	for i := range img.Metadata {
+		img.Metadata[i].SubtreeEnd = 0
+		img.Metadata[i].Children = nil
+	}
+	withoutPointers := listings()
+
+	// The entries are sorted by name, directories are not listed after files
+	exp := []string{"/Apples.txt", "/Groceries", "/Oranges.txt", "/Groceries/Bananas.txt", "/Groceries/Sub", "/Groceries/Sub/Figs.txt", "/Groceries/Sub/Kiwi.txt"}
+	for _, names := range [][]string{withPointers, withoutPointers} {
+		if strings.Join(names, " ") != strings.Join(exp, " ") {
+			t.Errorf("img.Children() = %v, expected %v", names, exp)
+		}
+	}
+}
+
+func TestDirEndMarkers(t *testing.T) {
+	// Metadata as written before format version 6: directories are closed by ".."
+	dir := func(name string) manager.FileMetadata {
+		return manager.FileMetadata{Begin: -1, End: -1, Name: name, Type: manager.Directory}
+	}
+	file := func(name string) manager.FileMetadata {
+		return manager.FileMetadata{Name: name, Type: manager.RegularFile}
+	}
+	img := &reader.Image{
+		Footer: manager.Footer{Version: 2},
+		Metadata: []manager.FileMetadata{
+			file("a"), dir("d"), file("b"), dir("e"), file("c"), dir(".."), file("f"), dir(".."), file("g"),
+		},
+	}
+	manager.LinkParents(img.Metadata)
+
+	parents := []int{-1, -1, 1, 1, 3, 3, 1, 1, -1}
+	for i, p := range parents {
+		if img.Metadata[i].Parent != p {
+			t.Errorf("Metadata[%d].Parent = %v, expected %v", i, img.Metadata[i].Parent, p)
+		}
+	}
+	if d := img.Metadata[1]; d.NumChildren != 3 || d.SubtreeEnd != 7 {
+		t.Errorf("/d has %v children ending at %v, expected 3 ending at 7", d.NumChildren, d.SubtreeEnd)
+	}
+
+	var paths []string
+	for _, e := range img.Entries() {
+		paths = append(paths, e.Path)
+	}
+	if exp := "/a /d /d/b /d/e /d/e/c /d/f /g"; strings.Join(paths, " ") != exp {
+		t.Errorf("img.Entries() paths = %v, expected %v", paths, exp)
+	}
+
+	var names []string
+	for _, e := range img.Children("/d") {
+		names = append(names, e.Name)
+	}
+	if strings.Join(names, " ") != "b e f" {
+		t.Errorf("img.Children(/d) = %v, expected [b e f]", names)
+	}
+	if e, ok := img.Lookup("/d/e/c"); !ok || e.Index != 4 {
+		t.Errorf("img.Lookup(/d/e/c) = %+v, %v, expected entry 4", e, ok)
+	}
+	if e, ok := img.EntryAt(6); !ok || e.Path != "/d/f" {
+		t.Errorf("img.EntryAt(6) = %+v, %v, expected /d/f", e, ok)
+	}
+	if problems := img.Verify(); len(problems) != 0 {
+		t.Errorf("img.Verify() = %v, expected no problems", problems)
+	}
+}
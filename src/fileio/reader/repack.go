@@ -0,0 +1,156 @@
+package reader
+
+import (
+	"fmt"
+	"sort"
+
+	"manager"
+)
+
+// DataOrders are the orders Repack can write the file data in. The metadata always
+// keeps the directory structure of the source image.
+var DataOrders = map[string]func(a, b *Entry) bool{
+	// dfs is the order of the metadata, as written by WalkDir
+	"dfs": func(a, b *Entry) bool { return a.Index < b.Index },
+	// offset keeps the data order of the source image
+	"offset": func(a, b *Entry) bool { return a.Begin < b.Begin },
+	// path sorts the data by full path
+	"path": func(a, b *Entry) bool { return a.Path < b.Path },
+	// size puts the smallest files first
+	"size": func(a, b *Entry) bool { return a.Size() < b.Size() },
+}
+
+// RepackOptions controls the data order of Repack
+type RepackOptions struct {
+	// Order is one of DataOrders, "dfs" if empty
+	Order string
+
+	// First lists image paths whose data is written before all other files, in
+	// that order
+	First []string
+}
+
+// Repack writes all entries of img to the image of z, whose Writer is
+// initialized, with the layout of z. All data is read from img, the directory it
+// was built from is not needed.
+func (img *Image) Repack(z *manager.ZarManager, opts RepackOptions) error {
+	files, err := img.dataOrder(opts)
+	if err != nil {
+		return err
+	}
+	written, err := img.copyData(z, files)
+	if err != nil {
+		return err
+	}
+	img.copyMetadata(z, written)
+
+	z.GenerateFilter()
+	return z.WriteHeader()
+}
+
+// dataOrder returns the metadata indices of the regular files of img in the order
+// their data is written
+func (img *Image) dataOrder(opts RepackOptions) ([]int, error) {
+	order := opts.Order
+	if order == "" {
+		order = "dfs"
+	}
+	less, ok := DataOrders[order]
+	if !ok {
+		return nil, fmt.Errorf("unknown order %q", order)
+	}
+
+	var files []Entry
+	for _, e := range img.Entries() {
+		if e.Type == manager.RegularFile {
+			files = append(files, e)
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool { return less(&files[i], &files[j]) })
+
+	// rank is the position of a path in First
+	rank := make(map[string]int)
+	for _, p := range opts.First {
+		if _, ok := rank[Clean(p)]; !ok {
+			rank[Clean(p)] = len(rank)
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		ri, iok := rank[files[i].Path]
+		rj, jok := rank[files[j].Path]
+		if iok && jok {
+			return ri < rj
+		}
+		return iok && !jok
+	})
+
+	indices := make([]int, len(files))
+	for i, e := range files {
+		indices[i] = e.Index
+	}
+	return indices, nil
+}
+
+// copyData writes the data of the regular files of img (metadata indices in
+// files) to the image of z and returns their new Metadata by index
+func (img *Image) copyData(z *manager.ZarManager, files []int) (map[int]manager.FileMetadata, error) {
+	written := make(map[int]manager.FileMetadata)
+	// Hard links of the source (same Ino) are written once
+	links := make(map[uint64]manager.FileMetadata)
+	for _, i := range files {
+		if h, ok := links[img.Metadata[i].Ino]; ok {
+			written[i] = h
+			continue
+		}
+		content, err := img.Content(&img.Metadata[i])
+		if err != nil {
+			return nil, err
+		}
+		e, _ := img.EntryAt(i)
+		h, err := z.WriteContent(e.Path, content)
+		if err != nil {
+			return nil, fmt.Errorf("can't write %v: %v", img.Metadata[i].Name, err)
+		}
+		written[i] = h
+		if ino := img.Metadata[i].Ino; ino != 0 && img.Nlink(&Entry{FileMetadata: img.Metadata[i], Index: i}) > 1 {
+			h.Ino = ino
+			links[ino] = h
+			written[i] = h
+		}
+	}
+	return written, nil
+}
+
+// copyMetadata adds the metadata of img to z in its original order. Regular files
+// take their location from written (see copyData).
+func (img *Image) copyMetadata(z *manager.ZarManager, written map[int]manager.FileMetadata) {
+	// Directories are ended once an entry outside of them comes up
+	var open []int
+	for i := range img.Metadata {
+		m := &img.Metadata[i]
+		if m.IsDirEnd() {
+			continue
+		}
+		for len(open) > 0 && open[len(open)-1] != m.Parent {
+			z.IncludeFolderEnd()
+			open = open[:len(open)-1]
+		}
+
+		switch m.Type {
+		case manager.RegularFile:
+			h := written[i]
+			h.Name, h.ModTime, h.Mode = m.Name, m.ModTime, m.Mode
+			z.IncludeFileMetadata(h)
+		case manager.Directory:
+			z.IncludeFolderBegin(m.Name, m.ModTime, m.Mode)
+			open = append(open, i)
+		case manager.Symlink:
+			z.IncludeSymlink(m.Name, m.Link, m.ModTime, m.Mode)
+		case manager.WhiteoutFile:
+			z.IncludeWhiteoutFile(m.Name, m.ModTime)
+		}
+	}
+	for range open {
+		z.IncludeFolderEnd()
+	}
+}
@@ -0,0 +1,166 @@
+package reader_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fileio/reader"
+	"manager"
+	"stats"
+)
+
+// repackSource writes a tree with compressible, tiny, duplicate, hard linked and
+// symlinked files into dir and creates the image dir/src.img from it, compressed
+// and with inline files
+func repackSource(t *testing.T, dir string) string {
+	text := ""
+	for i := 0; len(text) < 6000; i++ {
+		text += fmt.Sprintf("line %v of the grocery list\n", i)
+	}
+	files := map[string]string{
+		"Groceries.txt":        text,
+		"Apples.txt":           "apples",
+		"Empty":                "",
+		"Fruit/Bananas.txt":    strings.Repeat("bananas ", 40),
+		"Fruit/Copy.txt":       text,
+		"Fruit/Tree/Figs.txt":  "figs and more figs",
+		"Fruit/Tree/Dates.bin": strings.Repeat("\x00\x01\x02", 700),
+	}
+	root := filepath.Join(dir, "root")
+	for p, content := range files {
+		fn := filepath.Join(root, p)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("Fruit/Bananas.txt", filepath.Join(root, "Link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(root, "Fruit/Bananas.txt"), filepath.Join(root, "Fruit/Tree/Plantains.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	fn := filepath.Join(dir, "src.img")
+	writeImage(&manager.ZarManager{
+		Compression: "flate",
+		ChunkSize:   1024,
+		InlineLimit: 8,
+		Statistics:  &stats.ImgStats{},
+	}, root, fn)
+	return fn
+}
+
+func TestRepack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src, err := reader.Open(repackSource(t, dir))
+	if err != nil {
+		t.Fatalf("reader.Open of the source failed: %v", err)
+	}
+	defer src.Close()
+	if e, _ := src.Lookup("/Groceries.txt"); e.Codec != "flate" {
+		t.Fatalf("source Groceries.txt is compressed with %q, expected flate", e.Codec)
+	}
+	if e, _ := src.Lookup("/Apples.txt"); !e.IsInline() {
+		t.Fatalf("source Apples.txt is not inline")
+	}
+
+	tests := []struct {
+		name  string
+		z     manager.ZarManager
+		opts  reader.RepackOptions
+		check func(t *testing.T, img *reader.Image)
+	}{
+		{
+			name: "aligned",
+			z:    manager.ZarManager{Alignment: 4096, PackThreshold: 100},
+			check: func(t *testing.T, img *reader.Image) {
+				for _, p := range []string{"/Groceries.txt", "/Fruit/Copy.txt", "/Fruit/Tree/Dates.bin", "/Fruit/Bananas.txt"} {
+					if e, _ := img.Lookup(p); e.Begin%4096 != 0 || e.Codec != "" {
+						t.Errorf("%v begins at %v with codec %q, expected it uncompressed and aligned to 4096", p, e.Begin, e.Codec)
+					}
+				}
+				if e, _ := img.Lookup("/Apples.txt"); e.IsInline() {
+					t.Errorf("Apples.txt is inline without an inline limit")
+				}
+			},
+		},
+		{
+			name: "dedup",
+			z:    manager.ZarManager{Dedup: true, Compression: "flate", InlineLimit: 8},
+			check: func(t *testing.T, img *reader.Image) {
+				a, _ := img.Lookup("/Groceries.txt")
+				b, _ := img.Lookup("/Fruit/Copy.txt")
+				if a.Begin != b.Begin || a.End != b.End || a.Codec != "flate" {
+					t.Errorf("Groceries.txt [%v, %v) and Fruit/Copy.txt [%v, %v) don't share one compressed extent",
+						a.Begin, a.End, b.Begin, b.End)
+				}
+				if e, _ := img.Lookup("/Apples.txt"); !e.IsInline() {
+					t.Errorf("Apples.txt is not inline")
+				}
+			},
+		},
+		{
+			name: "orderfile",
+			z:    manager.ZarManager{},
+			opts: reader.RepackOptions{Order: "size", First: []string{"Fruit/Tree/Dates.bin", "/Groceries.txt", "/Groceries.txt"}},
+			check: func(t *testing.T, img *reader.Image) {
+				var last int64 = -1
+				for _, p := range []string{"/Fruit/Tree/Dates.bin", "/Groceries.txt", "/Empty", "/Apples.txt", "/Fruit/Tree/Figs.txt", "/Fruit/Bananas.txt", "/Fruit/Copy.txt"} {
+					e, _ := img.Lookup(p)
+					if e.Begin < last {
+						t.Errorf("%v begins at %v before the file preceding it in the order", p, e.Begin)
+					}
+					last = e.Begin
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			z := tt.z
+			z.Statistics = &stats.ImgStats{}
+			fn := filepath.Join(dir, tt.name+".img")
+			z.Writer.Init(fn)
+			if err := src.Repack(&z, tt.opts); err != nil {
+				t.Fatalf("Repack failed: %v", err)
+			}
+
+			img, err := reader.Open(fn)
+			if err != nil {
+				t.Fatalf("reader.Open(%v) failed: %v", fn, err)
+			}
+			defer img.Close()
+
+			if changes := reader.Diff(src, img, reader.DiffOptions{}); len(changes) != 0 {
+				t.Errorf("reader.Diff(src, repacked) = %v, expected no changes", changes)
+			}
+			if problems := img.Verify(); len(problems) != 0 {
+				t.Errorf("img.Verify() = %v, expected no problems", problems)
+			}
+			a, _ := img.Lookup("/Fruit/Bananas.txt")
+			b, _ := img.Lookup("/Fruit/Tree/Plantains.txt")
+			if img.Ino(&a) != img.Ino(&b) || a.Begin != b.Begin || img.Nlink(&a) != 2 {
+				t.Errorf("the hard links Fruit/Bananas.txt and Fruit/Tree/Plantains.txt are not kept")
+			}
+			tt.check(t, img)
+		})
+	}
+
+	z := &manager.ZarManager{Statistics: &stats.ImgStats{}}
+	z.Writer.Init(filepath.Join(dir, "bad.img"))
+	if err := src.Repack(z, reader.RepackOptions{Order: "random"}); err == nil {
+		t.Errorf("Repack with an unknown order succeeded")
+	}
+}
@@ -0,0 +1,312 @@
+package reader
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"manager"
+)
+
+// Problem is an inconsistency found by Verify
+type Problem struct {
+	// Index is the index of the offending entry in Image.Metadata, -1 for the image as a whole
+	Index int
+
+	// Path is the full path of the entry, if known
+	Path string
+
+	// Msg describes the problem
+	Msg string
+}
+
+// String formats the problem for reports
+func (p Problem) String() string {
+	if p.Index < 0 {
+		return fmt.Sprintf("image: %v", p.Msg)
+	}
+	if p.Path == "" {
+		return fmt.Sprintf("entry %d: %v", p.Index, p.Msg)
+	}
+	return fmt.Sprintf("entry %d (%v): %v", p.Index, p.Path, p.Msg)
+}
+
+// Verify checks the structural consistency of the whole image and returns every
+// problem found. An empty result means the image is consistent.
+//
+// Checks:
+//   - data of regular files lies inside the data region, or is inline up to the recorded limit
+//   - data extents do not overlap, except identical extents when the image records dedup
+//   - data begins at the alignment recorded for the file (format version 10), or
+//     else at the alignment boundary of the image unless the file is below the
+//     threshold of packed files; alignments are powers of two
+//   - directory begin and ".." markers balance (before format version 6)
+//   - the parent of each entry is a directory before it and the entries inside a
+//     directory follow it (format version 6)
+//   - directories record their number of children and the end of their subtree (format version 4)
+//   - child tables list the children of each directory sorted by name, if the image has them
+//   - names are valid, see manager.ValidName
+//   - the PT_LOAD segments of ELF files marked for mapping can be mapped from the image
+//   - compressed files have a valid chunk table and decompress to their size
+//   - symlinks have a target and no data, other entries have no link target
+//   - every file and symlink path tests positive in the stored filter
+//   - every entry is found at its path through the path index, if the image has one
+func (img *Image) Verify() []Problem {
+	var problems []Problem
+	report := func(i int, p string, format string, args ...interface{}) {
+		problems = append(problems, Problem{Index: i, Path: p, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	paths := make(map[int]string)
+	for _, e := range img.Entries() {
+		paths[e.Index] = e.Path
+	}
+
+	// Directory structure, skip pointers and names
+	markers := img.Footer.FormatVersion() < 6
+	skipPointers := img.Footer.FormatVersion() >= 4
+	var open []int
+	children := make(map[int][]int) // Indices of the entries inside each directory, -1 for the root
+	for i := range img.Metadata {
+		m := &img.Metadata[i]
+		p := paths[i]
+
+		if markers && m.IsDirEnd() {
+			if len(open) == 0 {
+				report(i, "", "directory end marker without matching directory")
+				continue
+			}
+			d := open[len(open)-1]
+			open = open[:len(open)-1]
+			if dm := &img.Metadata[d]; skipPointers && (dm.SubtreeEnd != i || dm.NumChildren != len(children[d])) {
+				report(d, paths[d], "directory records %v children ending at %v, found %v ending at %v",
+					dm.NumChildren, dm.SubtreeEnd, len(children[d]), i)
+			}
+			continue
+		}
+
+		if err := manager.ValidName(m.Name); err != nil {
+			report(i, p, "%v", err)
+		}
+
+		parent := -1
+		if markers {
+			if len(open) > 0 {
+				parent = open[len(open)-1]
+			}
+			if m.Type == manager.Directory {
+				open = append(open, i)
+			}
+		} else {
+			parent = m.Parent
+			if parent < -1 || parent >= i || parent >= 0 && img.Metadata[parent].Type != manager.Directory {
+				report(i, p, "parent %v is not a directory before the entry", parent)
+				continue
+			}
+			if !img.inside(i-1, parent) {
+				report(i, p, "entry does not follow the other entries of its directory %v", parent)
+			}
+		}
+		children[parent] = append(children[parent], i)
+	}
+	for _, i := range open {
+		report(i, paths[i], "directory is never closed by a \"..\" marker")
+	}
+	if !markers {
+		for d := range img.Metadata {
+			dm := &img.Metadata[d]
+			if dm.Type != manager.Directory {
+				continue
+			}
+
+			// The subtree ends after the last child, or after its subtree
+			c := children[d]
+			end := d + 1
+			if len(c) > 0 {
+				last := c[len(c)-1]
+				end = last + 1
+				if img.Metadata[last].Type == manager.Directory {
+					end = img.Metadata[last].SubtreeEnd
+				}
+			}
+			if dm.SubtreeEnd != end || dm.NumChildren != len(c) {
+				report(d, paths[d], "directory records %v children ending at %v, found %v ending at %v",
+					dm.NumChildren, dm.SubtreeEnd, len(c), end)
+			}
+		}
+	}
+
+	// Child tables, which must hold the children in name order
+	if img.Footer.SortedChildren {
+		for i := -1; i < len(img.Metadata); i++ {
+			table, p := img.Footer.RootChildren, "/"
+			if i >= 0 {
+				m := &img.Metadata[i]
+				if m.Type != manager.Directory || markers && m.IsDirEnd() {
+					continue
+				}
+				table, p = m.Children, paths[i]
+			}
+			if !sameIndices(table, children[i]) {
+				report(i, p, "child table %v does not match the children %v", table, children[i])
+				continue
+			}
+			for k := 1; k < len(table); k++ {
+				if img.Metadata[table[k-1]].Name > img.Metadata[table[k]].Name {
+					report(i, p, "child table is not sorted: %q before %q",
+						img.Metadata[table[k-1]].Name, img.Metadata[table[k]].Name)
+					break
+				}
+			}
+		}
+	}
+
+	// Data extents and link targets
+	alignOk := true
+	if err := manager.ValidAlignment(img.Footer.Alignment); err != nil {
+		report(-1, "", "%v", err)
+		alignOk = false
+	}
+	perFile := img.Footer.FormatVersion() >= 10 // Files record their alignment
+	var files []int
+	for i := range img.Metadata {
+		m := &img.Metadata[i]
+		p := paths[i]
+
+		if len(m.Inline) > 0 && m.Type != manager.RegularFile {
+			report(i, p, "%v has inline content", m.Type)
+		}
+		switch m.Type {
+		case manager.RegularFile:
+			if m.IsInline() {
+				if m.End != -1 {
+					report(i, p, "inline file has data [%v, %v)", m.Begin, m.End)
+				}
+				if n := int64(len(m.Inline)); n > img.Footer.InlineLimit {
+					report(i, p, "inline content of %v bytes exceeds the limit of %v", n, img.Footer.InlineLimit)
+				}
+				continue
+			}
+			if m.Begin < 0 || m.End < m.Begin || m.End > img.HeaderLoc {
+				report(i, p, "data [%v, %v) is outside of the data region [0, %v)", m.Begin, m.End, img.HeaderLoc)
+				continue
+			}
+			if perFile {
+				if err := manager.ValidAlignment(m.Align); err != nil {
+					report(i, p, "%v", err)
+				} else if m.Align > 0 && m.Begin%m.Align != 0 {
+					report(i, p, "data begins at %v, which is not aligned to %v", m.Begin, m.Align)
+				}
+			} else if a := img.Footer.Alignment; a > 0 && alignOk && m.Begin%a != 0 && m.Size() >= img.Footer.PackThreshold {
+				report(i, p, "data begins at %v, which is not aligned to %v", m.Begin, a)
+			}
+			if m.MapPage != 0 {
+				img.verifyMapping(i, p, report)
+			}
+			if m.Codec != "" {
+				if _, err := img.Content(m); err != nil {
+					report(i, p, "can't decompress: %v", err)
+				}
+			}
+			files = append(files, i)
+		case manager.Symlink:
+			if m.Link == "" {
+				report(i, p, "symlink has no target")
+			} else if strings.IndexByte(m.Link, 0) >= 0 {
+				report(i, p, "symlink target %q contains NUL", m.Link)
+			}
+			if m.Begin != -1 || m.End != -1 {
+				report(i, p, "symlink has data [%v, %v)", m.Begin, m.End)
+			}
+		default:
+			if m.Link != "" {
+				report(i, p, "%v has link target %q", m.Type, m.Link)
+			}
+		}
+	}
+
+	sort.SliceStable(files, func(a, b int) bool {
+		return img.Metadata[files[a]].Begin < img.Metadata[files[b]].Begin
+	})
+	// last is the extent reaching furthest among the ones checked so far
+	last := -1
+	for _, i := range files {
+		cur := &img.Metadata[i]
+		if cur.Begin == cur.End {
+			continue
+		}
+		if last >= 0 {
+			prev := &img.Metadata[last]
+			// Deduplicated files and hard links (same Ino) share their data
+			shared := (img.Footer.Dedup || cur.Ino != 0 && cur.Ino == prev.Ino) &&
+				cur.Begin == prev.Begin && cur.End == prev.End
+			if cur.Begin < prev.End && !shared {
+				report(i, paths[i], "data [%v, %v) overlaps entry %d [%v, %v)",
+					cur.Begin, cur.End, last, prev.Begin, prev.End)
+			}
+			if cur.End <= prev.End {
+				continue
+			}
+		}
+		last = i
+	}
+
+	// Filter membership, hashed the same way as ZarManager.constructFilter
+	if img.FilterMetadata.Active {
+		for _, e := range img.Entries() {
+			if e.Type != manager.RegularFile && e.Type != manager.Symlink {
+				continue
+			}
+			if img.Filter.FilterSize == 0 {
+				report(-1, "", "filter is active but empty")
+				break
+			}
+			if !img.Filter.TestElement([]byte(e.Path)) {
+				report(e.Index, e.Path, "path is not in the filter")
+			}
+		}
+	}
+
+	// Path index, checked against the paths rebuilt by Entries
+	if len(img.index) > 0 {
+		if n := len(img.index) / manager.IndexEntrySize; n != len(img.Entries()) {
+			report(-1, "", "path index has %v entries, expected %v", n, len(img.Entries()))
+		}
+		for _, e := range img.Entries() {
+			if found, ok := img.Lookup(e.Path); !ok || found.Index != e.Index {
+				report(e.Index, e.Path, "path is not in the path index")
+			}
+		}
+	}
+
+	return problems
+}
+
+// verifyMapping checks that the segments of the ELF file at index i, which is
+// marked for mapping, lie at image offsets congruent to their virtual addresses
+func (img *Image) verifyMapping(i int, p string, report func(int, string, string, ...interface{})) {
+	m := &img.Metadata[i]
+	if m.MapPage < 0 || manager.ValidAlignment(m.MapPage) != nil {
+		report(i, p, "map page size %v is not a power of two", m.MapPage)
+		return
+	}
+	residue, ok := manager.ELFResidue(img.Data[m.Begin:m.End], m.MapPage)
+	if !ok {
+		report(i, p, "marked for mapping but its segments can't be mapped")
+	} else if m.Begin%m.MapPage != residue {
+		report(i, p, "data begins at %v, its segments need %v modulo %v", m.Begin, residue, m.MapPage)
+	}
+}
+
+// sameIndices reports whether a and b hold the same indices in the same order
+func sameIndices(a []int, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k := range a {
+		if a[k] != b[k] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,59 @@
+package reader_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"fileio/reader"
+	"manager"
+)
+
+func TestVerify(t *testing.T) {
+	fn, dir := buildImage(t, map[string]string{
+		"Apples.txt":            "apples",
+		"Groceries/Bananas.txt": "bananas",
+		"Oranges.txt":           "oranges",
+	}, 4096)
+	defer os.RemoveAll(dir)
+
+	img, err := reader.Open(fn)
+	if err != nil {
+		t.Fatalf("reader.Open(%v) failed: %v", fn, err)
+	}
+	defer img.Close()
+
+	if problems := img.Verify(); len(problems) != 0 {
+		t.Fatalf("img.Verify() of a fresh image = %v, expected no problems", problems)
+	}
+
+	// Corrupt the decoded metadata: overlapping and misaligned data, bad names
+	// (including a directory end marker of the old format) and a child table out of order
+	apples, _ := img.Stat("/Apples.txt")
+	oranges, _ := img.Stat("/Oranges.txt")
+	img.Metadata[oranges.Index].Begin = apples.Begin + 1
+	img.Metadata[apples.Index].Name = "a/b"
+	img.Metadata = append(img.Metadata, manager.FileMetadata{Name: "..", Type: manager.Directory, Begin: -1, End: -1})
+	root := img.Footer.RootChildren
+	root[0], root[1] = root[1], root[0]
+
+	problems := img.Verify()
+	expected := []string{
+		"contains \"/\"",
+		"not aligned to 4096",
+		"overlaps entry",
+		"invalid name \"..\"",
+		"child table",
+	}
+	for _, exp := range expected {
+		found := false
+		for _, p := range problems {
+			if strings.Contains(p.String(), exp) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("img.Verify() = %v, expected a problem containing %q", problems, exp)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package writer
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// copyBufferSize is the size of the buffer copyReadWrite copies through
+const copyBufferSize = 1 << 20
+
+// copyExtent is a range of the image planned by FileWriter.Defer, whose data is
+// copied from a file when the image is closed
+type copyExtent struct {
+	// off is the offset of the extent in the image
+	off int64
+
+	// src is the name of the file the data is copied from, starting at its beginning
+	src string
+
+	// n is the size of the extent
+	n int64
+}
+
+// copyExtents preallocates the extents in the image file dst and copies the data
+// of each from its source file. Ranges of dst not covered by an extent are left
+// as they are, so padding that was skipped stays a hole. The image file has its
+// final size already; it is allocated extent by extent because a single
+// allocation of the whole file would fill the holes of the padding as well.
+//
+// A source file whose size is not the planned size changed since it was read in
+// the first pass, and copying fails. Content changed in place at the same size is
+// not detected: its checksum and deduplication were decided on the content read
+// in the first pass.
+func copyExtents(dst *os.File, extents []copyExtent) error {
+	for _, e := range extents {
+		preallocate(dst, e.off, e.n)
+	}
+
+	for _, e := range extents {
+		src, err := os.Open(e.src)
+		if err != nil {
+			return err
+		}
+		err = copySource(dst, e, src)
+		src.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copySource copies the data of the extent e from src, its opened source file
+func copySource(dst *os.File, e copyExtent, src *os.File) error {
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() != e.n {
+		return fmt.Errorf("%v has %v bytes, expected %v: file changed while being written", e.src, fi.Size(), e.n)
+	}
+	return copyRange(dst, e.off, src, e.n)
+}
+
+// copyReadWrite copies n bytes from the beginning of src to dst at offset off by
+// reading and writing them through a bounded buffer
+func copyReadWrite(dst *os.File, off int64, src *os.File, srcOff int64, n int64) error {
+	buf := make([]byte, copyBufferSize)
+	for n > 0 {
+		b := buf
+		if int64(len(b)) > n {
+			b = b[:n]
+		}
+		if _, err := src.ReadAt(b, srcOff); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if _, err := dst.WriteAt(b, off); err != nil {
+			return err
+		}
+		off, srcOff, n = off+int64(len(b)), srcOff+int64(len(b)), n-int64(len(b))
+	}
+	return nil
+}
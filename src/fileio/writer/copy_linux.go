@@ -0,0 +1,45 @@
+//go:build (linux && amd64) || (linux && arm64)
+// +build linux,amd64 linux,arm64
+
+package writer
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// preallocate allocates the blocks of n bytes at offset off of f, so that copying
+// into them does not fragment the file. It is only an optimization, so errors, e.g.
+// from file systems without fallocate(2), are ignored.
+func preallocate(f *os.File, off int64, n int64) {
+	syscall.Fallocate(int(f.Fd()), 0, off, n)
+}
+
+// copyRange copies n bytes from the beginning of src to dst at offset off with
+// copy_file_range(2), which lets the file system share the blocks (reflinks on XFS
+// and btrfs) or copy them in the kernel. It falls back to reading and writing
+// where copy_file_range does not work, e.g. between file systems on older kernels.
+func copyRange(dst *os.File, off int64, src *os.File, n int64) error {
+	var srcOff int64
+	for n > 0 {
+		// The kernel advances both offsets by the number of bytes copied
+		c, _, errno := syscall.Syscall6(sysCopyFileRange,
+			src.Fd(), uintptr(unsafe.Pointer(&srcOff)),
+			dst.Fd(), uintptr(unsafe.Pointer(&off)),
+			uintptr(n), 0)
+		switch errno {
+		case 0:
+		case syscall.ENOSYS, syscall.EXDEV, syscall.EINVAL, syscall.EOPNOTSUPP, syscall.EPERM:
+			return copyReadWrite(dst, off, src, srcOff, n)
+		default:
+			return errno
+		}
+		if c == 0 {
+			return io.ErrUnexpectedEOF
+		}
+		n -= int64(c)
+	}
+	return nil
+}
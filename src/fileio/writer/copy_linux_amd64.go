@@ -0,0 +1,4 @@
+package writer
+
+// sysCopyFileRange is the number of the copy_file_range system call
+const sysCopyFileRange = 326
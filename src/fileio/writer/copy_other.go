@@ -0,0 +1,16 @@
+//go:build !linux || (linux && !amd64 && !arm64)
+// +build !linux linux,!amd64,!arm64
+
+package writer
+
+import (
+	"os"
+)
+
+// preallocate does nothing where fallocate(2) is not available
+func preallocate(f *os.File, off int64, n int64) {}
+
+// copyRange copies n bytes from the beginning of src to dst at offset off
+func copyRange(dst *os.File, off int64, src *os.File, n int64) error {
+	return copyReadWrite(dst, off, src, 0, n)
+}
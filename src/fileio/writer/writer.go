@@ -5,14 +5,15 @@ import(
 	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"encoding/binary"
 )
 
-const(
-        pageBoundary = 4096     // The boundary that needs to be upheld for page alignment
- )
+// PageBoundary is the page size of the host, the boundary that needs to be upheld
+// for page alignment
+var PageBoundary = int64(os.Getpagesize())
 
 // FileWriter struct writes to a file
 type FileWriter struct {
@@ -24,6 +25,15 @@ type FileWriter struct {
 
         // f is the file object that the writer will write to
         F *os.File // TODO: Rename
+
+        // Deferred makes the writer build the image in two passes: data of files
+        // given to Defer is only planned, and padding is skipped instead of written.
+        // Close then copies the planned data into place (see copyExtents), so padding
+        // stays a hole in the image file.
+        Deferred bool
+
+        // copies are the extents planned by Defer, in the order of their offsets
+        copies []copyExtent
 }
 
 // Initializes a writer by creating the image file and attaching a writer to it\
@@ -50,49 +60,150 @@ func (w *FileWriter) Init(fn string) error {
 }
 
 // NOTE: in the new version FileWriter.Writer return the "real" end
-// Write writes the data to the zar file. The caller can specify whether or not
-// to keep the file page aligned
+// Write writes the data to the zar file. The caller can specify a boundary
+// (a power of two) that the file is padded to, so that the next write begins
+// aligned
 //
-// parameter (data)     : the data to be written
-// parameter (pageAlign): whether to page align the data
-func (w *FileWriter) Write(data []byte, pageAlign bool) (int64, error) {
+// parameter (data) : the data to be written
+// parameter (align): the boundary to pad to, 0 to not align the data
+func (w *FileWriter) Write(data []byte, align int64) (int64, error) {
         // Writes to FileWriter
         n, err := w.W.Write(data)
         if err != nil {
                 return int64(n), err
         }
 
-        // Adds padding if last page is not page aligned
-        n2 := 0
-        if pageAlign {
-                pad := (pageBoundary - n % pageBoundary) % pageBoundary
-                fmt.Printf("current write size: %v, padding size: %v\n", n, pad)
-                if pad > 0 {
-                        s := make([]byte, pad)
-                        n2, err = w.W.Write(s)
-                }
-        }
-
         // Updates offsets
         realEnd := w.Count + int64(n)
-        w.Count += int64(n + n2)
+        w.Count += int64(n)
+
+        // Adds padding if the end of the data is not aligned
+        if align > 0 {
+                fmt.Printf("current write size: %v, padding size: %v\n", n, (align - w.Count % align) % align)
+                err = w.Pad(align)
+        }
 
         return realEnd, err
 }
 
+// Pad writes zeros until the end of the file is aligned to align, so that the
+// next write begins at the boundary
+//
+// parameter (align): the boundary to pad to, 0 to not pad
+func (w *FileWriter) Pad(align int64) error {
+        if align <= 0 || w.Count % align == 0 {
+                return nil
+        }
+        if w.Deferred {
+                return w.skip(align - w.Count % align)
+        }
+        n, err := w.W.Write(make([]byte, align - w.Count % align))
+        w.Count += int64(n)
+        return err
+}
+
+// Defer writes the n bytes at the beginning of the file src. If the writer is
+// Deferred the data is not copied until Close, otherwise it is copied now.
+//
+// parameter (src): the name of the file to copy
+// parameter (n)  : the number of bytes to copy
+func (w *FileWriter) Defer(src string, n int64) error {
+        if !w.Deferred {
+                f, err := os.Open(src)
+                if err != nil {
+                        return err
+                }
+                defer f.Close()
+                m, err := w.ReadFrom(io.LimitReader(f, n))
+                if err == nil && m != n {
+                        err = io.ErrUnexpectedEOF
+                }
+                return err
+        }
+
+        w.copies = append(w.copies, copyExtent{off: w.Count, src: src, n: n})
+        return w.skip(n)
+}
+
+// skip leaves n bytes of the image file unwritten, as a hole unless they are
+// written later
+func (w *FileWriter) skip(n int64) error {
+        if err := w.W.Flush(); err != nil {
+                return err
+        }
+        if _, err := w.F.Seek(n, io.SeekCurrent); err != nil {
+                return err
+        }
+        w.Count += n
+        return nil
+}
+
+// ReadFrom writes the data read from r until EOF to the zar file through the
+// buffer of the writer, so data of any size is written with bounded memory. It
+// implements io.ReaderFrom.
+//
+// parameter (r): the reader of the data to be written
+func (w *FileWriter) ReadFrom(r io.Reader) (int64, error) {
+        n, err := w.W.ReadFrom(r)
+        w.Count += n
+        return n, err
+}
+
+// Truncate discards everything written from offset off on, so that the next
+// write begins at off
+//
+// parameter (off): the offset to continue writing at, at most Count
+func (w *FileWriter) Truncate(off int64) error {
+        if off > w.Count {
+                return fmt.Errorf("can't truncate to %v, only %v bytes written", off, w.Count)
+        }
+        if err := w.W.Flush(); err != nil {
+                return err
+        }
+        if err := w.F.Truncate(off); err != nil {
+                return err
+        }
+        if _, err := w.F.Seek(off, io.SeekStart); err != nil {
+                return err
+        }
+        w.Count = off
+
+        // Planned copies are in the order of their offsets
+        for len(w.copies) > 0 && w.copies[len(w.copies)-1].off >= off {
+                w.copies = w.copies[:len(w.copies)-1]
+        }
+        return nil
+}
+
 // WriteInt64 writes a int64 to the FileWriter
 //
 // parameter (v): the value to be written
 func (w *FileWriter) WriteInt64(v int64) (int64, error) {
         buf := make([]byte, binary.MaxVarintLen64)
         binary.PutVarint(buf, v)
-        n, err := w.Write(buf, false)
+        n, err := w.Write(buf, 0)
         return n, err
 }
 
-// Close closes the filewriter by flushing any buffer
+// Close closes the filewriter by flushing any buffer. If the writer is Deferred,
+// the image file gets its final size and the planned data is copied into place.
 func (w *FileWriter) Close() error {
         fmt.Println("Written Bytes: ", w.Count, "+ metadata size")
-        w.W.Flush()
+        if err := w.W.Flush(); err != nil {
+                w.F.Close()
+                return err
+        }
+        if w.Deferred {
+                // Padding at the end was skipped, not written
+                if err := w.F.Truncate(w.Count); err != nil {
+                        w.F.Close()
+                        return err
+                }
+                if err := copyExtents(w.F, w.copies); err != nil {
+                        w.F.Close()
+                        return err
+                }
+                w.copies = nil
+        }
         return w.F.Close()
 }
@@ -0,0 +1,37 @@
+package manager
+
+// AlignPolicy decides the alignment of the data of each regular file written to
+// an image, e.g. to align only the files consumers mmap (see package policy)
+type AlignPolicy interface {
+	// Alignment returns the alignment (0 for none) of the data of the file at the
+	// image path p, given its size and the first bytes of its content (head). ok is
+	// false if the policy does not decide for the file.
+	Alignment(p string, size int64, head []byte) (align int64, ok bool)
+}
+
+// AlignPolicyFunc is a function implementing AlignPolicy
+type AlignPolicyFunc func(p string, size int64, head []byte) (int64, bool)
+
+// Alignment implements AlignPolicy.Alignment
+func (f AlignPolicyFunc) Alignment(p string, size int64, head []byte) (int64, bool) {
+	return f(p, size, head)
+}
+
+// headSize is the number of bytes at the beginning of a file that the Policy and the
+// compression decide on, see AlignPolicy.Alignment
+const headSize = 4096
+
+// fileAlignment returns the alignment of the data of the file at the image path p
+// with the given size and first bytes of content (head): the one chosen by the
+// Policy, otherwise Alignment unless the file is below the PackThreshold
+func (z *ZarManager) fileAlignment(p string, size int64, head []byte) int64 {
+	if z.Policy != nil {
+		if align, ok := z.Policy.Alignment(p, size, head); ok {
+			return align
+		}
+	}
+	if size < z.PackThreshold {
+		return 0
+	}
+	return z.Alignment
+}
@@ -0,0 +1,83 @@
+package manager
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+
+	"codec"
+)
+
+// DefaultChunkSize is the size of the chunks the data of files is compressed in,
+// so that reads only decompress the chunks they need
+const DefaultChunkSize = 64 << 10
+
+// compressChunks compresses the data read from r (size bytes) with the codec name
+// in chunks of chunkSize bytes, holding one chunk in memory at a time, and passes
+// each compressed chunk to write. It returns the end offset of each compressed
+// chunk relative to the beginning of the compressed data, and its size. Once the
+// compressed data is not smaller than size it stops compressing but still reads r
+// to the end, and the caller stores the data as is instead.
+func compressChunks(name string, r io.Reader, size int64, chunkSize int64, write func([]byte) error) ([]int64, int64, error) {
+	c, err := codec.Get(name)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var chunks []int64
+	var stored int64
+	buf := make([]byte, chunkSize)
+	for stored < size {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			b, err := c.Compress(buf[:n])
+			if err != nil {
+				return nil, 0, err
+			}
+			if err := write(b); err != nil {
+				return nil, 0, err
+			}
+			stored += int64(len(b))
+			chunks = append(chunks, stored)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return chunks, stored, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	_, err = io.Copy(ioutil.Discard, r)
+	return chunks, stored, err
+}
+
+// chunkSize returns the size of the chunks files are compressed in
+func (z *ZarManager) chunkSize() int64 {
+	if z.ChunkSize <= 0 {
+		return DefaultChunkSize
+	}
+	return z.ChunkSize
+}
+
+// encodeSection encodes v as a section of the image: gob encoded, then compressed
+// with the codec name, or base64 encoded if name is "". It returns the section and
+// the size of the gob encoding, which readers need to decompress it.
+func encodeSection(v interface{}, name string) ([]byte, int64, error) {
+	b := bytes.Buffer{}
+	if err := gob.NewEncoder(&b).Encode(v); err != nil {
+		return nil, 0, err
+	}
+	if name == "" {
+		return []byte(base64.StdEncoding.EncodeToString(b.Bytes())), int64(b.Len()), nil
+	}
+
+	c, err := codec.Get(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	section, err := c.Compress(b.Bytes())
+	return section, int64(b.Len()), err
+}
@@ -0,0 +1,43 @@
+package manager
+
+import (
+	"bytes"
+	"debug/elf"
+	"io"
+)
+
+// ELFResidue returns the offset modulo page at which the data of an ELF file must
+// begin in the image so that the file offset of each PT_LOAD segment is congruent
+// to its virtual address modulo page, i.e. so the segments can be mapped straight
+// out of the image. ok is false if content is not an ELF file with loadable
+// segments or no offset satisfies all of them.
+func ELFResidue(content []byte, page int64) (residue int64, ok bool) {
+	return ELFResidueAt(bytes.NewReader(content), page)
+}
+
+// ELFResidueAt is ELFResidue for the content read from r, of which it reads only
+// the headers
+func ELFResidueAt(r io.ReaderAt, page int64) (residue int64, ok bool) {
+	magic := make([]byte, len(elf.ELFMAG))
+	if _, err := r.ReadAt(magic, 0); err != nil || string(magic) != elf.ELFMAG {
+		return 0, false
+	}
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return 0, false
+	}
+
+	residue = -1
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_LOAD {
+			continue
+		}
+		// Unsigned arithmetic wraps, which keeps the result right modulo a power of two
+		r := int64((p.Vaddr - p.Off) % uint64(page))
+		if residue >= 0 && r != residue {
+			return 0, false
+		}
+		residue = r
+	}
+	return residue, residue >= 0
+}
@@ -0,0 +1,130 @@
+package manager
+
+import (
+	"fmt"
+
+	"filter"
+)
+
+const (
+	// FormatVersion is the version of the image format written by ZarManager.
+	// Images written before the Footer was introduced decode with Version 0 and
+	// are reported as version 1. Version 3 adds the path index, version 4 the
+	// subtree skip pointers of directories, version 5 sorted child tables and
+	// version 6 replaces the ".." directory end markers with parent references,
+	// version 7 adds inode numbers, version 8 packs small files without alignment,
+	// version 9 stores the content of tiny files inline in the metadata, version 10
+	// records the alignment of each file, version 11 places ELF files so their
+	// segments can be mapped, version 12 compresses file data in chunks and version
+	// 13 may compress the metadata and filter sections.
+	FormatVersion = 13
+)
+
+// Footer is the last section of the image file, located by the int64 at the very
+// end of the file. It extends filter.FilterMetadata with the layout of the image.
+// The filter fields keep their names so readers that only decode a
+// filter.FilterMetadata (e.g. ContainerFS) can still read it.
+type Footer struct {
+	// Active indicates whether or not a bloom filter is enforced for this layer
+	Active bool
+
+	// Name represents the name of the filter used for this layer
+	Name string
+
+	// FilterLoc is the offset of the encoded filter
+	FilterLoc int64
+
+	// FilterStructSize is the size in bytes of the encoded filter
+	FilterStructSize int64
+
+	// Version is the image format version. 0 for images written without a Footer
+	Version int
+
+	// Alignment is the boundary the data of files begins at, 0 if not aligned. It
+	// is a power of two, e.g. 512 for block devices or the page size for mmap.
+	Alignment int64
+
+	// PackThreshold is the size below which files are packed without alignment,
+	// 0 if the data of every file is aligned
+	PackThreshold int64
+
+	// InlineLimit is the size up to which the content of files may be stored inline
+	// in the metadata, 0 if every file has a data extent
+	InlineLimit int64
+
+	// ELFPage is the page size ELF files were placed for, 0 if they were not (see
+	// FileMetadata.MapPage)
+	ELFPage int64
+
+	// Compression is the codec files were compressed with, "" if they were not.
+	// Files record their own codec, see FileMetadata.Codec
+	Compression string
+
+	// ChunkSize is the size of the chunks files were compressed in
+	ChunkSize int64
+
+	// SectionCodec is the codec the metadata and filter sections are compressed
+	// with instead of being base64 encoded, "" if they are not. The footer itself
+	// is always base64 encoded.
+	SectionCodec string
+
+	// MetadataSize and FilterSize are the sizes of the gob encoded metadata and
+	// filter before compression, set with SectionCodec
+	MetadataSize int64
+	FilterSize   int64
+
+	// Dedup indicates that files with identical content may share one data extent
+	Dedup bool
+
+	// IndexLoc is the offset of the path index, which follows the filter
+	IndexLoc int64
+
+	// IndexSize is the size in bytes of the path index, 0 if the image has none
+	IndexSize int64
+
+	// SortedChildren indicates that the children of every directory are sorted by
+	// name and that directories hold child tables
+	SortedChildren bool
+
+	// RootChildren is the child table of the root directory, which has no entry
+	RootChildren []int
+}
+
+// NewFooter creates the footer for the given filter metadata
+func NewFooter(fm filter.FilterMetadata) Footer {
+	return Footer{
+		Active:           fm.Active,
+		Name:             fm.Name,
+		FilterLoc:        fm.FilterLoc,
+		FilterStructSize: fm.FilterStructSize,
+		Version:          FormatVersion,
+	}
+}
+
+// FilterMetadata returns the filter fields of the footer
+func (f *Footer) FilterMetadata() filter.FilterMetadata {
+	return filter.FilterMetadata{
+		Active:           f.Active,
+		Name:             f.Name,
+		FilterLoc:        f.FilterLoc,
+		FilterStructSize: f.FilterStructSize,
+	}
+}
+
+// FormatVersion returns the image format version, treating images written without
+// a Footer as version 1
+func (f *Footer) FormatVersion() int {
+	if f.Version == 0 {
+		return 1
+	}
+	return f.Version
+}
+
+// ValidAlignment returns an error if files can't be aligned to a: it must be 0 (no
+// alignment) or a power of two
+func ValidAlignment(a int64) error {
+	if a < 0 || a&(a-1) != 0 {
+		return fmt.Errorf("alignment %v is not a power of two", a)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package manager_test
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"testing"
+
+	"filter"
+	"manager"
+)
+
+// roundTrip gob encodes v, as WriteHeader does, and decodes it into out
+func roundTrip(t *testing.T, v interface{}, out interface{}) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(v); err != nil {
+		t.Fatalf("gob Encode of %+v failed: %v", v, err)
+	}
+	if err := gob.NewDecoder(&b).Decode(out); err != nil {
+		t.Fatalf("gob Decode of %+v failed: %v", v, err)
+	}
+}
+
+func TestFooter(t *testing.T) {
+	fm := filter.FilterMetadata{Active: true, Name: "BloomFilter", FilterLoc: 8192, FilterStructSize: 96}
+	footer := manager.NewFooter(fm)
+	if footer.Version != manager.FormatVersion || footer.FormatVersion() != manager.FormatVersion {
+		t.Errorf("NewFooter() has version %v, expected %v", footer.Version, manager.FormatVersion)
+	}
+	if footer.FilterMetadata() != fm {
+		t.Errorf("footer.FilterMetadata() = %+v, expected %+v", footer.FilterMetadata(), fm)
+	}
+
+	footer.Alignment, footer.PackThreshold, footer.InlineLimit, footer.ELFPage = 4096, 1024, 32, 4096
+	footer.Compression, footer.ChunkSize = "flate", manager.DefaultChunkSize
+	footer.SectionCodec, footer.MetadataSize, footer.FilterSize = "gzip", 700, 120
+	footer.Dedup, footer.SortedChildren = true, true
+	footer.IndexLoc, footer.IndexSize = 9000, 64
+	footer.RootChildren = []int{0, 2, 5}
+
+	var decoded manager.Footer
+	roundTrip(t, footer, &decoded)
+	if !reflect.DeepEqual(decoded, footer) {
+		t.Errorf("footer decoded as %+v, expected %+v", decoded, footer)
+	}
+
+	// Readers that only know the filter metadata still read the footer
+	var legacyReader filter.FilterMetadata
+	roundTrip(t, footer, &legacyReader)
+	if legacyReader != fm {
+		t.Errorf("footer decoded as filter metadata %+v, expected %+v", legacyReader, fm)
+	}
+
+	// Images written before the footer hold only the filter metadata
+	var legacy manager.Footer
+	roundTrip(t, fm, &legacy)
+	if legacy.Version != 0 || legacy.FormatVersion() != 1 {
+		t.Errorf("legacy footer has version %v reported as %v, expected 0 reported as 1", legacy.Version, legacy.FormatVersion())
+	}
+	if legacy.FilterMetadata() != fm {
+		t.Errorf("legacy footer.FilterMetadata() = %+v, expected %+v", legacy.FilterMetadata(), fm)
+	}
+	if !reflect.DeepEqual(legacy, manager.Footer{Active: fm.Active, Name: fm.Name, FilterLoc: fm.FilterLoc, FilterStructSize: fm.FilterStructSize}) {
+		t.Errorf("legacy footer has layout fields set: %+v", legacy)
+	}
+}
+
+func TestValidAlignment(t *testing.T) {
+	for _, a := range []int64{0, 1, 512, 4096, 1 << 21} {
+		if err := manager.ValidAlignment(a); err != nil {
+			t.Errorf("ValidAlignment(%v) failed: %v", a, err)
+		}
+	}
+	for _, a := range []int64{-1, -4096, 3, 1000, 4097} {
+		if err := manager.ValidAlignment(a); err == nil {
+			t.Errorf("ValidAlignment(%v) succeeded, expected an error", a)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package manager
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sort"
+)
+
+// IndexEntrySize is the size in bytes of an encoded IndexEntry
+const IndexEntrySize = 16
+
+// IndexEntry maps the hash of the full path of an entry to its position in the
+// metadata. The index section is an array of IndexEntry sorted by Hash (then
+// Index), encoded little endian so that it can be searched in place:
+//
+//	| hash uint64 | index int32 | parent int32 |
+type IndexEntry struct {
+	// Hash is HashPath of the full path of the entry
+	Hash uint64
+
+	// Index is the index of the entry in the metadata
+	Index int32
+
+	// Parent is the index of the directory containing the entry, -1 for the root.
+	// It lets readers confirm a hash match without rebuilding the path.
+	Parent int32
+}
+
+// HashPath returns the hash of a full image path (e.g. "/usr/lib/x.so") stored in the index
+func HashPath(p string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(p))
+	return h.Sum64()
+}
+
+// EncodeIndex builds the index section for the given metadata. Every entry is indexed.
+func EncodeIndex(metadata []FileMetadata) []byte {
+	var entries []IndexEntry
+	Walk(metadata, func(i int, p string, m *FileMetadata) error {
+		entries = append(entries, IndexEntry{Hash: HashPath(p), Index: int32(i), Parent: int32(m.Parent)})
+		return nil
+	})
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Hash != entries[j].Hash {
+			return entries[i].Hash < entries[j].Hash
+		}
+		return entries[i].Index < entries[j].Index
+	})
+
+	b := make([]byte, len(entries)*IndexEntrySize)
+	for i, e := range entries {
+		r := b[i*IndexEntrySize:]
+		binary.LittleEndian.PutUint64(r, e.Hash)
+		binary.LittleEndian.PutUint32(r[8:], uint32(e.Index))
+		binary.LittleEndian.PutUint32(r[12:], uint32(e.Parent))
+	}
+	return b
+}
+
+// IndexEntryAt decodes the i-th entry of an encoded index section
+func IndexEntryAt(index []byte, i int) IndexEntry {
+	r := index[i*IndexEntrySize:]
+	return IndexEntry{
+		Hash:   binary.LittleEndian.Uint64(r),
+		Index:  int32(binary.LittleEndian.Uint32(r[8:])),
+		Parent: int32(binary.LittleEndian.Uint32(r[12:])),
+	}
+}
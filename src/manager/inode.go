@@ -0,0 +1,25 @@
+package manager
+
+// RootIno is the inode number of the root directory, which has no entry
+const RootIno = 1
+
+// AssignInodes sets the inode number (Ino) of every entry from its index: entry i
+// gets i+2, so that numbers are stable for an image and never 0 or RootIno.
+//
+// An Ino set before is taken as a hard link group: entries with the same non-zero
+// Ino share the inode number of the first of them.
+func AssignInodes(metadata []FileMetadata) {
+	groups := make(map[uint64]uint64)
+	for i := range metadata {
+		m := &metadata[i]
+		ino := uint64(i) + 2
+		if m.Ino != 0 {
+			if first, ok := groups[m.Ino]; ok {
+				ino = first
+			} else {
+				groups[m.Ino] = ino
+			}
+		}
+		m.Ino = ino
+	}
+}
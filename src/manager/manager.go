@@ -4,14 +4,21 @@ package manager
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/base64"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
+	"syscall"
 
+	"codec"
 	"fileio/writer"
 	"filter"
 	"stats"
@@ -29,6 +36,21 @@ const (
 	WhiteoutFile
 )
 
+// String returns the short name of the file type used in listings
+func (t fileType) String() string {
+	switch t {
+	case RegularFile:
+		return "file"
+	case Directory:
+		return "dir"
+	case Symlink:
+		return "symlink"
+	case WhiteoutFile:
+		return "whiteout"
+	}
+	return "unknown"
+}
+
 // Manager is an interface for creating the image file.
 // This interface allows for multiple implementations of its creation.
 type Manager interface {
@@ -87,12 +109,115 @@ type FileMetadata struct {
 
 	// TODO: What does this do
 	Mode os.FileMode
+
+	// Checksum is the hex encoded SHA-256 of the content of a regular file. Empty if
+	// the image was written without checksums
+	Checksum string
+
+	// Parent is the index of the directory containing the entry, -1 for the root.
+	// Images written before format version 6 mark the end of a directory with an
+	// entry named ".." instead, see LinkParents
+	Parent int
+
+	// NumChildren is the number of entries directly inside a directory
+	NumChildren int
+
+	// SubtreeEnd is the index following the last entry inside a directory, so readers
+	// can skip its subtree. 0 if the image was written without skip pointers
+	SubtreeEnd int
+
+	// Children holds the indices of the entries directly inside a directory sorted
+	// by name, for binary search. Nil if the image was written in KeepOrder
+	Children []int
+
+	// Ino is the inode number of the entry, unique except for hard links which share
+	// it. 0 if the image was written without inode numbers (before format version 7)
+	Ino uint64
+
+	// Inline is the content of a tiny regular file stored in the metadata, which
+	// then has no data extent (Begin and End are -1). See ZarManager.InlineLimit
+	Inline []byte
+
+	// Align is the alignment the data of a regular file was written with, 0 if it
+	// is not aligned. See ZarManager.Policy
+	Align int64
+
+	// MapPage is set for ELF files placed so that their PT_LOAD segments can be
+	// mapped straight out of the image with pages of this size (see ELFResidue).
+	// 0 if the file is not placed for mapping.
+	MapPage int64
+
+	// Codec is the codec (see package codec) the data of a regular file is
+	// compressed with, "" if it is stored as is
+	Codec string
+
+	// RawSize is the size of the data of a compressed file before compression
+	RawSize int64
+
+	// ChunkSize is the size of the chunks the data of a compressed file is
+	// compressed in, each on its own so that reads only decompress what they need
+	ChunkSize int64
+
+	// Chunks holds, for each chunk of a compressed file, the end of its compressed
+	// data relative to Begin. The last one is End - Begin.
+	Chunks []int64
 }
 
 // Manager is the main driver of creating the image file. It writes the data and stores Metadata.
 type ZarManager struct {
-        // PageAlign indicates whether files will be aligned at page boundaries
-        PageAlign bool
+        // Alignment is the boundary (a power of two) the data of files begins at,
+        // 0 to not align files. writer.PageBoundary aligns them to pages.
+        Alignment int64
+
+	// PackThreshold is the size below which files are packed together without
+	// alignment, so tiny files don't take a whole aligned block. 0 aligns every file.
+	PackThreshold int64
+
+	// Policy decides the alignment of each file, for the files it matches. Other
+	// files are aligned to Alignment unless they are below PackThreshold.
+	Policy AlignPolicy
+
+	// ELFPage is the page size ELF executables and libraries are placed for, so that
+	// their loadable segments can be mapped from the image. 0 places them like
+	// other files.
+	ELFPage int64
+
+	// Compression is the codec (see package codec) files are compressed with, ""
+	// to store them as is. Files aligned for mmap are not compressed.
+	Compression string
+
+	// ChunkSize is the size of the chunks files are compressed in. 0 uses
+	// DefaultChunkSize
+	ChunkSize int64
+
+	// SectionCodec is the codec (see package codec) the metadata and filter sections
+	// are compressed with, "" to write them base64 encoded. The data region is not
+	// affected, so it stays mappable.
+	SectionCodec string
+
+	// InlineLimit is the size up to which the content of files is stored inline in
+	// the metadata instead of the data region. 0 stores every file in the data region.
+	InlineLimit int64
+
+	// Checksum indicates whether the SHA-256 of each regular file is stored in its Metadata
+	Checksum bool
+
+	// Dedup indicates whether regular files with identical content share one data extent
+	Dedup bool
+
+	// FPProb is the false positive probability of the generated filter. 0 uses filter.DEFAULT_PROB
+	FPProb float64
+
+	// KeepOrder keeps the entries in the order they were included instead of sorting
+	// the children of each directory by name and writing child tables (see SortMetadata)
+	KeepOrder bool
+
+	// Workers is the number of files WalkDir reads, hashes and compresses in
+	// parallel. The files are still written in the order of a serial walk, so the
+	// image is the same for any number of workers. 0 or 1 walks serially. Only
+	// files up to prefetchSize are read ahead, larger ones are streamed when they
+	// are written as in a serial walk.
+	Workers int
 
         // The FileWriter for this zar image
         Writer writer.FileWriter
@@ -108,6 +233,32 @@ type ZarManager struct {
 
 	// Filter is a filter used for this image file
 	Filter *filter.BloomFilter
+
+	// extents maps the content written so far and its placement to its Metadata
+	// when Dedup is set
+	extents map[extentKey]FileMetadata
+
+	// openDirs holds the indices of the directories begun but not yet ended
+	openDirs []int
+
+	// metadataSize is the size of the gob encoded metadata, set by WriteFileMetadata
+	metadataSize int64
+
+	// rootChildren is the child table of the root directory, set by WriteHeader
+	rootChildren []int
+
+	// hardLinks maps the device and inode of files with several names included so
+	// far to their Metadata, whose Ino is the hard link group (see AssignInodes)
+	hardLinks map[[2]uint64]FileMetadata
+}
+
+// extentKey identifies a data extent that files with the same content can share:
+// its SHA-256 and the placement it was written with, so a file deduplicated
+// against it gets the alignment and ELF mapping it needs
+type extentKey struct {
+	checksum string
+	align    int64
+	mapPage  int64
 }
 
 type DirInfo struct {
@@ -118,10 +269,20 @@ type DirInfo struct {
 
 // WalkDir implemented Manager.WalkDir
 func (z *ZarManager) WalkDir(dir string, foldername string, mod_time int64, mode os.FileMode, root bool) {
+        if z.Workers > 1 {
+                z.walkParallel(dir, foldername, mod_time, mode, root)
+                return
+        }
+        z.walk(dir, foldername, mod_time, mode, root, z.include)
+}
+
+// walk walks the directory dir depth first and passes an operation including each
+// entry to visit, in the order they are included in the image
+func (z *ZarManager) walk(dir string, foldername string, mod_time int64, mode os.FileMode, root bool, visit func(*walkOp)) {
         // root dir not marked as directory
         if !root {
                 fmt.Printf("including folder: %v, name: %v\n", dir, foldername)
-                z.IncludeFolderBegin(foldername, mod_time, mode)
+                visit(&walkOp{kind: opDirBegin, name: foldername, modTime: mod_time, mode: mode})
         }
 
         // Retrieve all files in current directory
@@ -146,7 +307,7 @@ func (z *ZarManager) WalkDir(dir string, foldername string, mod_time int64, mode
 	                  if size != 0 {
 	                    log.Fatalf("character device with non-zero size is not a whiteout file.")
 	                  }
-	                  z.IncludeWhiteoutFile(name, mod_time)
+	                  visit(&walkOp{kind: opWhiteout, name: name, modTime: mod_time})
                 } else if symlink {
                         // Symbolic link is an indirection, thus read and include
                         fmt.Printf("%v is symlink.", file_path)
@@ -155,11 +316,11 @@ func (z *ZarManager) WalkDir(dir string, foldername string, mod_time int64, mode
                                 log.Fatalf("error. Can't read symlink file. %v", real_dest)
                         }
                         // TODO: Can we replace with file redirecting to here? Could eliminate symbolic links
-                        z.IncludeSymlink(name, real_dest, mod_time, mode)
+                        visit(&walkOp{kind: opSymlink, name: name, link: real_dest, modTime: mod_time, mode: mode})
                 } else {
                         if !file.IsDir() {
                                 fmt.Printf("including file: %v\n", name)
-                                z.IncludeFile(name, dir, mod_time, mode)
+                                visit(&walkOp{kind: opFile, name: name, dir: dir, fi: file})
                         } else {
                                 dirs = append(dirs, &DirInfo{name, mod_time, mode})
                         }
@@ -169,12 +330,12 @@ func (z *ZarManager) WalkDir(dir string, foldername string, mod_time int64, mode
         // Recursively search each directory (DFS)
         // After file processing to improve spatial locatlity for files
         for _, subDir := range dirs {
-                z.WalkDir(path.Join(dir, subDir.Name), subDir.Name, subDir.ModTime, subDir.Mode, false)
+                z.walk(path.Join(dir, subDir.Name), subDir.Name, subDir.ModTime, subDir.Mode, false, visit)
         }
 
         // root dir not marked as directory
         if !root {
-                z.IncludeFolderEnd()
+                visit(&walkOp{kind: opDirEnd})
         }
 }
 
@@ -191,22 +352,19 @@ func (z *ZarManager) IncludeFolderBegin(name string, mod_time int64, mode os.Fil
         }
 
         // Add to the image's Metadata at end
-        z.Metadata = append(z.Metadata, *h)
+        z.addEntry(*h)
+        z.openDirs = append(z.openDirs, len(z.Metadata)-1)
 
 	z.Statistics.AddDir()
 }
 
 // IncludeFolderEnd implements IncludeFolderEnd
 func (z *ZarManager) IncludeFolderEnd() {
-        h := &FileMetadata{
-                        Begin   : -1,
-                        End     : -1,
-                        Name    : "..",
-                        Type    : Directory,
+        // Entries added from now on are no longer inside the directory
+        if n := len(z.openDirs); n > 0 {
+                z.Metadata[z.openDirs[n-1]].SubtreeEnd = len(z.Metadata)
+                z.openDirs = z.openDirs[:n-1]
         }
-
-        // Add to the image's Metadata at end
-        z.Metadata = append(z.Metadata, *h)
 }
 
 func (z *ZarManager) IncludeWhiteoutFile(name string, mod_time int64) {
@@ -218,7 +376,7 @@ func (z *ZarManager) IncludeWhiteoutFile(name string, mod_time int64) {
 		  Type    : WhiteoutFile,
 		  ModTime : mod_time,
 	}
-	z.Metadata = append(z.Metadata, *h)
+	z.addEntry(*h)
 }
 
 // IncludeSymlink adds Metadata to the image file for a symbolic link. This
@@ -239,41 +397,359 @@ func (z *ZarManager) IncludeSymlink(name string, link string, modTime int64, mod
 		ModTime : modTime,
 		Mode	: mode,
         }
-        z.Metadata = append(z.Metadata, *h)
+        z.addEntry(*h)
 
 	z.Statistics.AddSymLink()
 }
 
-// IncludeFile implements Manager.IncludeFile
+// IncludeFile implements Manager.IncludeFile. The content is streamed into the
+// image, so files of any size are included with bounded memory.
 func (z *ZarManager) IncludeFile(fn string, basedir string, mod_time int64, mode os.FileMode) (int64, error) {
-        content, err := ioutil.ReadFile(path.Join(basedir, fn))
+        return z.includeFile(fn, basedir, mod_time, mode, nil)
+}
+
+// includeFile implements IncludeFile. If pre is not nil, it is the content of the
+// file prefetched by a worker of WalkDir.
+func (z *ZarManager) includeFile(fn string, basedir string, mod_time int64, mode os.FileMode, pre *prefetched) (int64, error) {
+        if pre != nil {
+                if pre.err != nil {
+                        log.Fatalf("can't include file %v, err: %v", fn, pre.err)
+                        return 0, pre.err
+                }
+                h, err := z.writeFile(z.imagePath(fn), bytes.NewReader(pre.content), int64(len(pre.content)), pre)
+                if err != nil {
+                        log.Fatalf("can't write file %v to the image, err: %v", fn, err)
+                        return 0, err
+                }
+                h.Name, h.ModTime, h.Mode = fn, mod_time, mode
+                z.IncludeFileMetadata(h)
+                return h.End, nil
+        }
+
+        f, err := os.Open(path.Join(basedir, fn))
         if err != nil {
                 log.Fatalf("can't include file %v, err: %v", fn, err)
                 return 0, nil
         }
+        defer f.Close()
 
-        // Retrieve the current offset into the file and write the file contents
-        oldCounter := z.Writer.Count
-        real_end, err := z.Writer.Write(content, z.PageAlign)
+        fi, err := f.Stat()
         if err != nil {
-                        log.Fatalf("can't write to file")
-                        return 0, err
+                log.Fatalf("can't stat file %v, err: %v", fn, err)
+                return 0, err
         }
 
-        // Create the file Metadata
-        h := &FileMetadata{
-		Begin   : oldCounter,
-		End     : real_end,
-		Name    : fn,
-		Type    : RegularFile,
-		ModTime : mod_time,
-		Mode	: mode,
+        h, err := z.WriteData(z.imagePath(fn), f, fi.Size())
+        if err != nil {
+                        log.Fatalf("can't write file %v to the image, err: %v", fn, err)
+                        return 0, err
         }
-        z.Metadata = append(z.Metadata, *h)
+
+        // Complete the file Metadata
+        h.Name = fn
+        h.ModTime = mod_time
+        h.Mode = mode
+        z.IncludeFileMetadata(h)
+
+        return h.End, err
+}
+
+// WriteContent writes the content of a regular file to the image file and returns
+// its Metadata, see WriteData
+//
+// parameter (p)        : the path of the file in the image, for the Policy
+// parameter (content)  : the data of the file
+// return               : Metadata of the file without name, modification time and mode
+func (z *ZarManager) WriteContent(p string, content []byte) (FileMetadata, error) {
+	return z.WriteData(p, bytes.NewReader(content), int64(len(content)))
+}
+
+// WriteData writes the content of a regular file, read from r, to the image file and
+// returns its Metadata with the location (and checksum) filled in. The content is
+// copied through a bounded buffer and hashed and compressed along the way, so only
+// files up to InlineLimit bytes are held in memory. With Dedup set, content that was
+// already written is discarded again and the existing extent is returned. Content
+// up to InlineLimit bytes is not written but returned in Inline. If the Writer is
+// Deferred, data read from an *os.File is copied when the image is closed.
+//
+// parameter (p)        : the path of the file in the image, for the Policy
+// parameter (r)        : the data of the file
+// parameter (size)     : the size of the file
+// return               : Metadata of the file without name, modification time and mode
+func (z *ZarManager) WriteData(p string, r io.ReaderAt, size int64) (FileMetadata, error) {
+	return z.writeFile(p, r, size, nil)
+}
+
+// writeFile implements WriteData. If pre is not nil, r holds the content of a file
+// that a worker of WalkDir has read, hashed and compressed ahead (see prefetch), so
+// only the writing is left.
+func (z *ZarManager) writeFile(p string, r io.ReaderAt, size int64, pre *prefetched) (FileMetadata, error) {
+	h := FileMetadata{Type: RegularFile}
+
+	if z.InlineLimit > 0 && size <= z.InlineLimit {
+		content := make([]byte, size)
+		if _, err := io.ReadFull(io.NewSectionReader(r, 0, size), content); err != nil {
+			return h, err
+		}
+		if z.Checksum {
+			s := sha256.Sum256(content)
+			h.Checksum = hex.EncodeToString(s[:])
+		}
+		h.Begin, h.End = -1, -1
+		h.Inline = content
+		z.Statistics.AddInline(size)
+		return h, nil
+	}
+
+	head := make([]byte, headSize)
+	n, err := io.ReadFull(io.NewSectionReader(r, 0, size), head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return h, err
+	}
+	head = head[:n]
+
+	// Unaligned files are packed after each other; aligned files begin at the
+	// boundary even if packed files come before them
+	align := z.fileAlignment(p, size, head)
+	// ELF files begin at the offset their segments need within a page
+	var residue int64
+	if z.ELFPage > 0 {
+		if res, ok := ELFResidueAt(io.NewSectionReader(r, 0, size), z.ELFPage); ok {
+			align, residue, h.MapPage = z.ELFPage, res, z.ELFPage
+		}
+	}
+	packed := align == 0 && z.Alignment > 0
+
+	// Files that are mapped are stored as is, as are files in a compressed format
+	compress := z.Compression != "" && align == 0 && h.MapPage == 0 && !codec.IsCompressed(head)
+
+	// Content hashed ahead is written only once for each placement
+	if pre != nil && z.Dedup {
+		if prev, ok := z.extents[extentKey{pre.checksum, align, h.MapPage}]; ok {
+			return prev, nil
+		}
+	}
+
+	start := z.Writer.Count
+	if err := z.Writer.Pad(align); err != nil {
+		return h, err
+	}
+	if residue > 0 {
+		if _, err := z.Writer.Write(make([]byte, residue), 0); err != nil {
+			return h, err
+		}
+	}
+
+	h.Begin = z.Writer.Count
+	var chunks []int64
+	var stored int64
+	var checksum string
+	if pre != nil {
+		data := pre.content
+		if compress && pre.chunks != nil {
+			data, chunks = pre.compressed, pre.chunks
+		}
+		if chunks == nil && z.Writer.Deferred {
+			// As in writeStream, the data is copied from the file when the image is closed
+			err = z.Writer.Defer(pre.fn, size)
+		} else {
+			_, err = z.Writer.Write(data, 0)
+		}
+		if err != nil {
+			return h, err
+		}
+		stored, checksum = int64(len(data)), pre.checksum
+	} else {
+		chunks, stored, checksum, err = z.writeStream(r, size, compress)
+		if err != nil {
+			return h, err
+		}
+		if z.Dedup {
+			if prev, ok := z.extents[extentKey{checksum, align, h.MapPage}]; ok {
+				return prev, z.Writer.Truncate(start)
+			}
+		}
+	}
+	if z.Checksum {
+		h.Checksum = checksum
+	}
+
+	if chunks != nil {
+		h.Codec, h.RawSize, h.ChunkSize, h.Chunks = z.Compression, size, z.chunkSize(), chunks
+		z.Statistics.AddCompressed(size, stored)
+	}
+
+	h.End = h.Begin + stored
+	if err := z.Writer.Pad(align); err != nil {
+		return h, err
+	}
+	if residue == 0 {
+		h.Align = align
+	}
+	if h.MapPage > 0 {
+		z.Statistics.NumMappable++
+	}
+	z.Statistics.AddData(z.Writer.Count-start, AlignUp(size, z.Alignment), packed)
+
+	if z.Dedup {
+		if z.extents == nil {
+			z.extents = make(map[extentKey]FileMetadata)
+		}
+		z.extents[extentKey{checksum, align, h.MapPage}] = h
+	}
+
+        return h, nil
+}
+
+// writeStream streams the content of a file, read from r, into the image and hashes
+// it on the way if the checksum is needed. If compress is set, the content is
+// compressed, unless that does not make it smaller. It returns the chunk table of
+// the compressed content (nil if it is stored as is), the number of bytes written
+// and the checksum.
+func (z *ZarManager) writeStream(r io.ReaderAt, size int64, compress bool) ([]int64, int64, string, error) {
+	content := io.NewSectionReader(r, 0, size)
+	src := io.Reader(content)
+	var sum hash.Hash
+	if z.Checksum || z.Dedup {
+		sum = sha256.New()
+		src = io.TeeReader(src, sum)
+	}
+
+	begin := z.Writer.Count
+	var chunks []int64
+	var stored int64
+	var err error
+	f, isFile := r.(*os.File)
+	switch {
+	case compress:
+		chunks, stored, err = compressChunks(z.Compression, src, size, z.chunkSize(), func(b []byte) error {
+			_, err := z.Writer.Write(b, 0)
+			return err
+		})
+	case isFile && z.Writer.Deferred:
+		// The data is copied from the file when the image is closed, it is only read
+		// now if it needs to be hashed
+		if sum != nil {
+			_, err = io.Copy(ioutil.Discard, src)
+		} else {
+			_, err = content.Seek(size, io.SeekStart)
+		}
+		if err == nil {
+			stored, err = size, z.Writer.Defer(f.Name(), size)
+		}
+	default:
+		stored, err = z.Writer.ReadFrom(src)
+	}
+	if err != nil {
+		return nil, 0, "", err
+	}
+	if n, _ := content.Seek(0, io.SeekCurrent); n != size {
+		return nil, 0, "", fmt.Errorf("read %v bytes, expected %v: file changed while being written", n, size)
+	}
+
+	// Content that compressing does not make smaller is written again as is
+	if compress && stored >= size {
+		if err := z.Writer.Truncate(begin); err != nil {
+			return nil, 0, "", err
+		}
+		if stored, err = z.Writer.ReadFrom(io.NewSectionReader(r, 0, size)); err != nil {
+			return nil, 0, "", err
+		}
+		chunks = nil
+	}
+
+	var checksum string
+	if sum != nil {
+		checksum = hex.EncodeToString(sum.Sum(nil))
+	}
+	return chunks, stored, checksum, nil
+}
+
+// imagePath returns the path in the image of the entry name in the directory
+// currently included
+func (z *ZarManager) imagePath(name string) string {
+	p := ""
+	for _, d := range z.openDirs {
+		p += "/" + z.Metadata[d].Name
+	}
+	return p + "/" + name
+}
+
+// AlignUp returns size rounded up to a multiple of align (a power of two, 0 for none)
+func AlignUp(size int64, align int64) int64 {
+	if align <= 0 {
+		return size
+	}
+	return (size + align - 1) &^ (align - 1)
+}
+
+// includeRegular includes the regular file described by fi from the directory dir,
+// whose content may have been prefetched (pre, nil if not). Further names of a hard
+// linked file share the data and the inode of the first one.
+func (z *ZarManager) includeRegular(name string, dir string, fi os.FileInfo, pre *prefetched) {
+	mod_time, mode := fi.ModTime().UnixNano(), fi.Mode()
+
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 {
+		z.includeFile(name, dir, mod_time, mode, pre)
+		return
+	}
+
+	key := [2]uint64{uint64(st.Dev), uint64(st.Ino)}
+	if h, ok := z.hardLinks[key]; ok {
+		h.Name, h.ModTime, h.Mode = name, mod_time, mode
+		z.IncludeFileMetadata(h)
+		return
+	}
+
+	z.includeFile(name, dir, mod_time, mode, pre)
+	if z.hardLinks == nil {
+		z.hardLinks = make(map[[2]uint64]FileMetadata)
+	}
+	h := &z.Metadata[len(z.Metadata)-1]
+	h.Ino = uint64(len(z.hardLinks)) + 1
+	z.hardLinks[key] = *h
+}
+
+// IncludeFileMetadata adds the Metadata of a regular file whose content has already
+// been written (see WriteContent) to the image
+//
+// parameter (h)        : complete Metadata of the file
+func (z *ZarManager) IncludeFileMetadata(h FileMetadata) {
+        z.addEntry(h)
 
 	z.Statistics.AddFile()
+}
+
+// addEntry appends the Metadata of a file, symlink, whiteout or directory to the
+// directory it is in
+func (z *ZarManager) addEntry(h FileMetadata) {
+	if err := ValidName(h.Name); err != nil {
+		log.Fatalf("can't include %v: %v", h.Name, err)
+	}
 
-        return real_end, err
+	h.Parent = -1
+	if n := len(z.openDirs); n > 0 {
+		h.Parent = z.openDirs[n-1]
+		z.Metadata[h.Parent].NumChildren++
+	}
+	z.Metadata = append(z.Metadata, h)
+}
+
+// ValidName returns an error if name can't be the name of an entry: it must not be
+// empty, ".", ".." or contain "/" or NUL
+func ValidName(name string) error {
+	switch {
+	case name == "":
+		return errors.New("empty name")
+	case name == "." || name == "..":
+		return fmt.Errorf("invalid name %q", name)
+	case strings.Contains(name, "/"):
+		return fmt.Errorf("name %q contains \"/\"", name)
+	case strings.IndexByte(name, 0) >= 0:
+		return fmt.Errorf("name %q contains NUL", name)
+	}
+	return nil
 }
 
 // GenerateFilter implements manager.GenerateFilter
@@ -281,7 +757,7 @@ func (z *ZarManager) GenerateFilter() {
 	// Check type of filter -> Default BloomFilter, later pass in
 
 	// Create initial filter -> Default Bloom, but later have swithc statement
-	z.Filter = &filter.BloomFilter{NumElem:z.Statistics.NumFiles}
+	z.Filter = &filter.BloomFilter{NumElem:z.Statistics.NumFiles, FPProb:z.FPProb}
 
 	// Initialize filter (TODO: Check error)
 	z.Filter.Initialize()
@@ -299,38 +775,16 @@ func (z *ZarManager) GenerateFilter() {
 }
 
 // ConstructFilter initializes a filter by looping over FileMetadata
-// and adding each file to the filter
-// Algorithm: 
-//	- string to hold current path
-//	- When encounter startDir, append '/dirname' to string
-//	- When encounter file/symlink, hash string + filename into filter
-// 	- When encounter endDir, remove previous name from string
+// and adding the full path of each file and symlink to the filter
 func (z *ZarManager) constructFilter() {
 	fmt.Println("Constructing Filter")
 
-	var path = ""
-
-	for i:=0; i < len(z.Metadata); i++ {
-		name:=z.Metadata[i].Name
-		switch MetaType := z.Metadata[i].Type; MetaType {
-		case (RegularFile):
-			// Add to filter
-			z.Filter.AddElement([]byte(path + "/" + name))
-		case (Directory):
-			// Name = ".." means end of directory
-			if (name == "..") {
-				// Remove dir name at end
-				intPath := strings.Split(path, "/")
-				intPath = intPath[:len(intPath)-1]
-				path = strings.Join(intPath, "/")
-			} else {
-				path += "/" + name
-			}
-		case (Symlink):
-			// Treat like a file, add and hash
-			z.Filter.AddElement([]byte(path + "/" + name))
+	Walk(z.Metadata, func(i int, p string, m *FileMetadata) error {
+		if m.Type == RegularFile || m.Type == Symlink {
+			z.Filter.AddElement([]byte(p))
 		}
-	}
+		return nil
+	})
 }
 
 // TODO: Is gob the best choice here? Need to use it to encode structs
@@ -338,6 +792,27 @@ func (z *ZarManager) constructFilter() {
 //	YES! Use BinaryMarshaler to make custom layout
 // WriteHeader implements Manager.WriteHeader
 func (z *ZarManager) WriteHeader() error {
+	// Only the metadata is reordered, the file data is already written
+	if !z.KeepOrder {
+		z.Metadata, z.rootChildren = SortMetadata(z.Metadata)
+	}
+	AssignInodes(z.Metadata)
+
+	if s := z.Statistics; z.Alignment > 0 && z.PackThreshold > 0 {
+		fmt.Printf("packed %v files below %v bytes: data region %v bytes, %v bytes saved over aligning every file\n",
+			s.NumPacked, z.PackThreshold, s.DataBytes, s.PackedSaved())
+	}
+
+	if s := z.Statistics; z.ELFPage > 0 {
+		fmt.Printf("placed %v ELF files for mapping with %v byte pages\n", s.NumMappable, z.ELFPage)
+	}
+	if s := z.Statistics; z.Compression != "" {
+		fmt.Printf("compressed %v files with %v: %v bytes stored as %v\n", s.NumCompressed, z.Compression, s.RawCompressed, s.StoredCompressed)
+	}
+	if s := z.Statistics; z.InlineLimit > 0 {
+		fmt.Printf("inlined %v files up to %v bytes: %v bytes in the metadata\n", s.NumInline, z.InlineLimit, s.InlineBytes)
+	}
+
 	z.WriteFileMetadata()
 
 	z.WriteFilterMetadata()
@@ -355,13 +830,12 @@ func (z *ZarManager) WriteFileMetadata() {
 	// Marshal metadata
 	gob.Register(FileMetadata{})
 
-	b := bytes.Buffer{}
-	e := gob.NewEncoder(&b)
-	err := e.Encode(z.Metadata)
+	section, size, err := encodeSection(z.Metadata, z.SectionCodec)
 	if err != nil { fmt.Println(`failed gob Encode`, err) }
+	z.metadataSize = size
 
         fmt.Println("current Metadata:", z.Metadata)
-	z.Writer.Write([]byte(base64.StdEncoding.EncodeToString(b.Bytes())), false) // Not pageAligned
+	z.Writer.Write(section, 0) // Not pageAligned
 
         // Write location of Metadata to end of file
         z.Writer.WriteInt64(int64(headerLoc))
@@ -376,13 +850,11 @@ func (z *ZarManager) WriteFilterMetadata() {
 	// Write filter data to file (Need to marshal Bloom Filter struct)
 	gob.Register(filter.BloomFilter{})
 
-	buf := bytes.Buffer{}
-	e := gob.NewEncoder(&buf)
-	err := e.Encode(z.Filter)
+	section, filterSize, err := encodeSection(z.Filter, z.SectionCodec)
 	if err != nil { fmt.Println(`failed gob Encode`, err) }
 
 	fmt.Println("Writing BloomFilter:", z.Filter)
-	z.Writer.Write([]byte(base64.StdEncoding.EncodeToString(buf.Bytes())), false) // Not pageAligned
+	z.Writer.Write(section, 0) // Not pageAligned
 
 	// Set size of BloomFilter
         filterLoc := z.Writer.Count     // Offset for Metadata in image file
@@ -393,19 +865,47 @@ func (z *ZarManager) WriteFilterMetadata() {
 	// Write filter metadata to file
         fmt.Printf("filter location: %v bytes\n", filterLoc)
 
+	// The filter metadata is written as part of the footer describing the image layout
+	footer := NewFooter(z.FilterMetadata)
+	footer.Alignment = z.Alignment
+	if z.Alignment > 0 {
+		footer.PackThreshold = z.PackThreshold
+	}
+	footer.InlineLimit = z.InlineLimit
+	footer.ELFPage = z.ELFPage
+	footer.Compression = z.Compression
+	if z.SectionCodec != "" {
+		footer.SectionCodec = z.SectionCodec
+		footer.MetadataSize, footer.FilterSize = z.metadataSize, filterSize
+	}
+	if z.Compression != "" {
+		footer.ChunkSize = z.chunkSize()
+	}
+	footer.Dedup = z.Dedup
+	footer.SortedChildren = !z.KeepOrder
+	footer.RootChildren = z.rootChildren
+
+	// The path index goes between the filter and the footer, where readers that
+	// only know the filter metadata do not look
+	footer.IndexLoc = z.Writer.Count
+	z.Writer.Write(EncodeIndex(z.Metadata), 0) // Not pageAligned
+	footer.IndexSize = z.Writer.Count - footer.IndexLoc
+
+	footerLoc := z.Writer.Count
+
 	// Marshal Metadata
-	gob.Register(filter.FilterMetadata{})
+	gob.Register(Footer{})
 
 	b := bytes.Buffer{}
-	e = gob.NewEncoder(&b)
-	err = e.Encode(z.FilterMetadata)
+	e := gob.NewEncoder(&b)
+	err = e.Encode(footer)
 	if err != nil { fmt.Println(`failed gob Encode`, err) }
 
-        fmt.Println("current FilterMetadata:", z.FilterMetadata)
-	z.Writer.Write([]byte(base64.StdEncoding.EncodeToString(b.Bytes())), false) // Not pageAligned
+        fmt.Println("current Footer:", footer)
+	z.Writer.Write([]byte(base64.StdEncoding.EncodeToString(b.Bytes())), 0) // Not pageAligned
 
 	// Write location of Metadata to end of file
-        z.Writer.WriteInt64(int64(filterLoc))
+        z.Writer.WriteInt64(int64(footerLoc))
 
 	// Flush the writer
 	z.Writer.W.Flush()
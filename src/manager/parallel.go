@@ -0,0 +1,187 @@
+package manager
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+
+	"codec"
+)
+
+// prefetchSize is the size up to which the workers of WalkDir read files ahead.
+// Larger files are streamed when they are written, as in a serial walk, so the
+// memory of a parallel walk stays bounded.
+const prefetchSize = 1 << 20
+
+// opKind is the kind of a walkOp
+type opKind int
+
+const (
+	opDirBegin opKind = iota
+	opDirEnd
+	opFile
+	opSymlink
+	opWhiteout
+)
+
+// walkOp is the inclusion of an entry found by walk
+type walkOp struct {
+	kind    opKind
+	name    string
+	modTime int64
+	mode    os.FileMode
+
+	// dir and fi are the directory and the file info of a regular file
+	dir string
+	fi  os.FileInfo
+
+	// link is the target of a symlink
+	link string
+
+	// pre receives the content of a regular file prefetched by a worker, nil if the
+	// file is not prefetched
+	pre chan *prefetched
+}
+
+// prefetched is the content of a regular file read, hashed and compressed ahead
+type prefetched struct {
+	// fn is the name of the file, whose data a Deferred Writer copies from it when
+	// the image is closed unless it is compressed
+	fn      string
+	content []byte
+
+	// checksum is the SHA-256 of content if Checksum or Dedup is set
+	checksum string
+
+	// compressed is content compressed with the Compression codec and chunks its
+	// chunk table, both nil if compressing does not make the content smaller
+	compressed []byte
+	chunks     []int64
+
+	// err is the error reading the file
+	err error
+}
+
+// include includes the entry of op in the image
+func (z *ZarManager) include(op *walkOp) {
+	switch op.kind {
+	case opDirBegin:
+		z.IncludeFolderBegin(op.name, op.modTime, op.mode)
+	case opDirEnd:
+		z.IncludeFolderEnd()
+	case opFile:
+		var pre *prefetched
+		if op.pre != nil {
+			pre = <-op.pre
+		}
+		z.includeRegular(op.name, op.dir, op.fi, pre)
+	case opSymlink:
+		z.IncludeSymlink(op.name, op.link, op.modTime, op.mode)
+	case opWhiteout:
+		z.IncludeWhiteoutFile(op.name, op.modTime)
+	}
+}
+
+// walkParallel is WalkDir with Workers prefetching files. The walk runs ahead of
+// the writing by a bounded number of entries and hands the files it finds to the
+// workers; this goroutine is the sequencer including the entries one after the
+// other in walk order, waiting for each file to be prefetched.
+func (z *ZarManager) walkParallel(dir string, foldername string, modTime int64, mode os.FileMode, root bool) {
+	ops := make(chan *walkOp, 2*z.Workers)
+	jobs := make(chan *walkOp)
+
+	var wg sync.WaitGroup
+	for i := 0; i < z.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for op := range jobs {
+				op.pre <- z.prefetch(path.Join(op.dir, op.name))
+			}
+		}()
+	}
+
+	go func() {
+		// Further names of hard linked files share the data of the first one
+		links := make(map[[2]uint64]bool)
+		z.walk(dir, foldername, modTime, mode, root, func(op *walkOp) {
+			if op.kind == opFile && op.fi.Size() <= prefetchSize && firstLink(op.fi, links) {
+				op.pre = make(chan *prefetched, 1)
+				jobs <- op
+			}
+			ops <- op
+		})
+		close(jobs)
+		close(ops)
+	}()
+
+	for op := range ops {
+		z.include(op)
+	}
+	wg.Wait()
+}
+
+// firstLink returns whether fi is the first name of its file met in the walk,
+// recording the names of hard linked files in links
+func firstLink(fi os.FileInfo, links map[[2]uint64]bool) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 {
+		return true
+	}
+	key := [2]uint64{uint64(st.Dev), uint64(st.Ino)}
+	if links[key] {
+		return false
+	}
+	links[key] = true
+	return true
+}
+
+// prefetch reads the file fn and hashes and compresses its content as writeFile
+// would. Files that grew beyond prefetchSize since the walk are not read, they are
+// streamed when they are written instead.
+func (z *ZarManager) prefetch(fn string) *prefetched {
+	f, err := os.Open(fn)
+	if err != nil {
+		return &prefetched{err: err}
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return &prefetched{err: err}
+	}
+	if fi.Size() > prefetchSize {
+		return nil
+	}
+
+	pre := &prefetched{fn: fn, content: make([]byte, fi.Size())}
+	if _, err := io.ReadFull(f, pre.content); err != nil {
+		return &prefetched{err: err}
+	}
+	if z.Checksum || z.Dedup {
+		s := sha256.Sum256(pre.content)
+		pre.checksum = hex.EncodeToString(s[:])
+	}
+
+	// Whether the file is compressed is decided when it is written
+	size := int64(len(pre.content))
+	if z.Compression != "" && !codec.IsCompressed(pre.content) && (z.InlineLimit <= 0 || size > z.InlineLimit) {
+		var compressed []byte
+		chunks, stored, err := compressChunks(z.Compression, bytes.NewReader(pre.content), size, z.chunkSize(), func(b []byte) error {
+			compressed = append(compressed, b...)
+			return nil
+		})
+		if err != nil {
+			return &prefetched{err: err}
+		}
+		if stored < size {
+			pre.compressed, pre.chunks = compressed, chunks
+		}
+	}
+	return pre
+}
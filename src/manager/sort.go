@@ -0,0 +1,63 @@
+package manager
+
+import (
+	"sort"
+)
+
+// metaNode is an entry of the metadata together with the entries inside it,
+// used to rewrite the metadata in sorted order
+type metaNode struct {
+	m        FileMetadata
+	children []*metaNode
+}
+
+// SortMetadata rewrites the metadata so that the children of every directory are
+// in name order, and fills in the child table (Children) of every directory. The
+// location of the file data is not changed. It returns the child table of the root.
+//
+// The sort is stable, so entries with the same name keep the order they were
+// included in.
+func SortMetadata(metadata []FileMetadata) ([]FileMetadata, []int) {
+	root := &metaNode{}
+	nodes := make([]*metaNode, len(metadata))
+	for i, m := range metadata {
+		if m.IsDirEnd() {
+			continue
+		}
+
+		parent := root
+		if m.Parent >= 0 && m.Parent < i && nodes[m.Parent] != nil {
+			parent = nodes[m.Parent]
+		}
+		nodes[i] = &metaNode{m: m}
+		parent.children = append(parent.children, nodes[i])
+	}
+
+	sorted := make([]FileMetadata, 0, len(metadata))
+	var emit func(n *metaNode, parent int) []int
+	emit = func(n *metaNode, parent int) []int {
+		sort.SliceStable(n.children, func(i, j int) bool {
+			return n.children[i].m.Name < n.children[j].m.Name
+		})
+
+		table := make([]int, len(n.children))
+		for k, c := range n.children {
+			i := len(sorted)
+			table[k] = i
+			c.m.Parent = parent
+			sorted = append(sorted, c.m)
+			if c.m.Type != Directory {
+				continue
+			}
+
+			children := emit(c, i)
+			sorted[i].Children = children
+			sorted[i].NumChildren = len(children)
+			sorted[i].SubtreeEnd = len(sorted)
+		}
+		return table
+	}
+	rootTable := emit(root, -1)
+
+	return sorted, rootTable
+}
@@ -0,0 +1,155 @@
+package manager
+
+import (
+	"os"
+	"syscall"
+)
+
+// WalkFunc is called by Walk for every entry of the image metadata.
+//
+// parameter (i)	: index of the entry in the metadata list
+// parameter (p)	: full path of the entry in the image, e.g. "/usr/lib/x.so"
+// parameter (m)	: the entry itself
+// return		: a non-nil error stops the walk and is returned by Walk
+type WalkFunc func(i int, p string, m *FileMetadata) error
+
+// Walk visits the metadata in the order it was written and reconstructs the full
+// path of each entry from its Parent. Directory end markers ("..") of images
+// written before format version 6 are not passed to fn.
+func Walk(metadata []FileMetadata, fn WalkFunc) error {
+	dirs := make(map[int]string)
+
+	for i := range metadata {
+		m := &metadata[i]
+		if m.IsDirEnd() {
+			continue
+		}
+
+		p := "/" + m.Name
+		if dir, ok := dirs[m.Parent]; ok && m.Parent < i {
+			p = dir + p
+		}
+		if err := fn(i, p, m); err != nil {
+			return err
+		}
+
+		if m.Type == Directory {
+			dirs[i] = p
+		}
+	}
+
+	return nil
+}
+
+// LinkParents fills in the Parent of every entry of metadata written before format
+// version 6, where the end of a directory is marked by an entry named "..". A marker
+// gets the directory it closes as Parent. NumChildren and SubtreeEnd are filled in
+// for directories that do not record them (before format version 4), SubtreeEnd
+// being the index of the marker.
+func LinkParents(metadata []FileMetadata) {
+	open := []int{}
+	children := make(map[int]int)
+	end := func(d int, i int) {
+		if m := &metadata[d]; m.SubtreeEnd == 0 {
+			m.SubtreeEnd = i
+			m.NumChildren = children[d]
+		}
+	}
+
+	for i := range metadata {
+		m := &metadata[i]
+		m.Parent = -1
+		if len(open) > 0 {
+			m.Parent = open[len(open)-1]
+			if !m.IsDirEnd() {
+				children[m.Parent]++
+			}
+		}
+
+		if m.IsDirEnd() {
+			if len(open) > 0 {
+				end(open[len(open)-1], i)
+				open = open[:len(open)-1]
+			}
+			continue
+		}
+		if m.Type == Directory {
+			open = append(open, i)
+		}
+	}
+
+	// Directories never closed end with the metadata
+	for _, d := range open {
+		end(d, len(metadata))
+	}
+}
+
+// IsDirEnd reports whether m marks the end of a directory in metadata written
+// before format version 6
+func (m *FileMetadata) IsDirEnd() bool {
+	return m.Type == Directory && m.Name == ".."
+}
+
+// FileMode returns the mode of the entry with the type bits set from Type, so that
+// entries written without a mode (e.g. from a config file) still report their type.
+func (m *FileMetadata) FileMode() os.FileMode {
+	mode := m.Mode
+	switch m.Type {
+	case Directory:
+		mode |= os.ModeDir
+	case Symlink:
+		mode |= os.ModeSymlink
+	case WhiteoutFile:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	}
+	return mode
+}
+
+// UnixMode returns the mode of the entry as in st_mode: file type bits, permission
+// bits and setuid, setgid and sticky. Whiteouts are character devices.
+func (m *FileMetadata) UnixMode() uint32 {
+	mode := m.FileMode()
+
+	u := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		u |= syscall.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		u |= syscall.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		u |= syscall.S_ISVTX
+	}
+
+	switch m.Type {
+	case RegularFile:
+		u |= syscall.S_IFREG
+	case Directory:
+		u |= syscall.S_IFDIR
+	case Symlink:
+		u |= syscall.S_IFLNK
+	case WhiteoutFile:
+		u |= syscall.S_IFCHR
+	}
+	return u
+}
+
+// Size returns the number of data bytes of the entry. Only regular files have data.
+func (m *FileMetadata) Size() int64 {
+	if m.Type != RegularFile {
+		return 0
+	}
+	if m.IsInline() {
+		return int64(len(m.Inline))
+	}
+	if m.Codec != "" {
+		return m.RawSize
+	}
+	return m.End - m.Begin
+}
+
+// IsInline returns whether the entry is a regular file whose content is stored in
+// Inline instead of the data region
+func (m *FileMetadata) IsInline() bool {
+	return m.Type == RegularFile && m.Begin < 0
+}
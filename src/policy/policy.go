@@ -0,0 +1,184 @@
+// Package policy implements rules deciding per file how its data is laid out in
+// an image, e.g. whether it is aligned so consumers can mmap it
+package policy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"manager"
+)
+
+// Magics are the magic numbers that rules can name instead of giving them in hex
+var Magics = map[string][]byte{
+	"elf":  {0x7f, 'E', 'L', 'F'},
+	"gzip": {0x1f, 0x8b},
+	"zstd": {0x28, 0xb5, 0x2f, 0xfd},
+	"xz":   {0xfd, '7', 'z', 'X', 'Z', 0x00},
+	"zip":  {'P', 'K', 0x03, 0x04},
+	"png":  {0x89, 'P', 'N', 'G'},
+	"jpeg": {0xff, 0xd8, 0xff},
+}
+
+// Rule decides the alignment of the files it matches. A rule without conditions
+// matches every file.
+type Rule struct {
+	// Align is the alignment of the data of matching files, 0 to not align them
+	Align int64
+
+	// Glob matches the name of the file, or its full image path if it contains "/"
+	// (see path.Match). Empty matches any file.
+	Glob string
+
+	// MinSize and MaxSize bound the size of matching files (inclusive), -1 for no bound
+	MinSize int64
+	MaxSize int64
+
+	// Magic is the prefix of the content of matching files, nil for any content
+	Magic []byte
+}
+
+// Match returns whether the file at the image path p with the given size and first
+// bytes of content (head) matches the rule
+func (r *Rule) Match(p string, size int64, head []byte) bool {
+	if r.Glob != "" {
+		name := path.Base(p)
+		if strings.Contains(r.Glob, "/") {
+			name = p
+		}
+		if ok, _ := path.Match(r.Glob, name); !ok {
+			return false
+		}
+	}
+	if r.MinSize >= 0 && size < r.MinSize || r.MaxSize >= 0 && size > r.MaxSize {
+		return false
+	}
+	return r.Magic == nil || bytes.HasPrefix(head, r.Magic)
+}
+
+// Rules is a list of rules where the first matching rule decides. It implements
+// manager.AlignPolicy.
+type Rules []Rule
+
+// Alignment implements manager.AlignPolicy.Alignment
+func (rules Rules) Alignment(p string, size int64, head []byte) (int64, bool) {
+	for i := range rules {
+		if rules[i].Match(p, size, head) {
+			return rules[i].Align, true
+		}
+	}
+	return 0, false
+}
+
+// Load reads the rules from the file fn, see Parse
+func Load(fn string, pageSize int64) (Rules, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rules, err := Parse(f, pageSize)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", fn, err)
+	}
+	return rules, nil
+}
+
+// Parse reads rules, one per line: an alignment followed by the conditions of the
+// rule. Empty lines and lines starting with "#" are ignored. e.g.
+//
+//	page magic=elf
+//	page glob=*.so*
+//	page minsize=1048576
+//	none
+//
+// The alignment is "page" (pageSize), "none" or a power of two. The conditions are
+// glob=PATTERN, minsize=N, maxsize=N and magic=NAME (see Magics) or magic=hex:BYTES.
+func Parse(r io.Reader, pageSize int64) (Rules, error) {
+	var rules Rules
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		rule, err := parseRule(fields, pageSize)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", n, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, s.Err()
+}
+
+// parseRule parses the fields of a rule line
+func parseRule(fields []string, pageSize int64) (Rule, error) {
+	rule := Rule{MinSize: -1, MaxSize: -1}
+
+	switch fields[0] {
+	case "page":
+		rule.Align = pageSize
+	case "none":
+		rule.Align = 0
+	default:
+		a, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return rule, fmt.Errorf("unknown alignment %q", fields[0])
+		}
+		if err := manager.ValidAlignment(a); err != nil {
+			return rule, err
+		}
+		rule.Align = a
+	}
+
+	for _, f := range fields[1:] {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			return rule, fmt.Errorf("condition %q is not key=value", f)
+		}
+		key, value := kv[0], kv[1]
+
+		var err error
+		switch key {
+		case "glob":
+			_, err = path.Match(value, "")
+			rule.Glob = value
+		case "minsize":
+			rule.MinSize, err = strconv.ParseInt(value, 10, 64)
+		case "maxsize":
+			rule.MaxSize, err = strconv.ParseInt(value, 10, 64)
+		case "magic":
+			rule.Magic, err = parseMagic(value)
+		default:
+			return rule, fmt.Errorf("unknown condition %q", key)
+		}
+		if err != nil {
+			return rule, fmt.Errorf("%v: %v", key, err)
+		}
+	}
+	return rule, nil
+}
+
+// parseMagic parses the magic of a rule: a name in Magics or hex:BYTES
+func parseMagic(value string) ([]byte, error) {
+	if strings.HasPrefix(value, "hex:") {
+		b, err := hex.DecodeString(value[len("hex:"):])
+		if err == nil && len(b) == 0 {
+			err = fmt.Errorf("empty magic")
+		}
+		return b, err
+	}
+	if b, ok := Magics[value]; ok {
+		return b, nil
+	}
+	return nil, fmt.Errorf("unknown magic %q", value)
+}
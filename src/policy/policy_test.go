@@ -0,0 +1,73 @@
+package policy_test
+
+import (
+	"strings"
+	"testing"
+
+	"policy"
+)
+
+const rules = `
+# mmapped files
+page magic=elf
+16384 glob=/usr/lib/*.so*
+page minsize=1048576
+
+none maxsize=100
+512
+`
+
+func TestRules(t *testing.T) {
+	r, err := policy.Parse(strings.NewReader(rules), 4096)
+	if err != nil {
+		t.Fatalf("policy.Parse failed: %v", err)
+	}
+	if len(r) != 5 {
+		t.Fatalf("policy.Parse returned %v rules, expected 5", len(r))
+	}
+
+	elf := []byte("\x7fELF\x02\x01\x01")
+	tests := []struct {
+		path  string
+		size  int64
+		head  []byte
+		align int64
+	}{
+		{"/bin/sh", 50, elf, 4096},
+		{"/usr/lib/libc.so.6", 50, nil, 16384},
+		{"/usr/lib/x/libc.so.6", 50, nil, 0},
+		{"/data/model.bin", 2 << 20, nil, 4096},
+		{"/etc/hostname", 100, []byte("host"), 0},
+		{"/etc/services", 101, []byte("# services"), 512},
+	}
+	for _, test := range tests {
+		align, ok := r.Alignment(test.path, test.size, test.head)
+		if !ok || align != test.align {
+			t.Errorf("Alignment(%v, %v) = %v, %v, expected %v", test.path, test.size, align, ok, test.align)
+		}
+	}
+
+	if _, ok := r[:3].Alignment("/etc/services", 101, nil); ok {
+		t.Errorf("Alignment(/etc/services) decided without a matching rule")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := map[string]string{
+		"huge":               "unknown alignment",
+		"3000":               "not a power of two",
+		"page glob":          "not key=value",
+		"page color=red":     "unknown condition",
+		"page minsize=big":   "minsize",
+		"page magic=tar":     "unknown magic",
+		"page magic=hex:zz":  "magic",
+		"page glob=[":        "glob",
+		"none\npage magic=x": "line 2",
+	}
+	for text, msg := range tests {
+		_, err := policy.Parse(strings.NewReader(text), 4096)
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("policy.Parse(%q) error = %v, expected one containing %q", text, err, msg)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// Package server implements read-only servers for the contents of an image file
+package server
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"fileio/reader"
+	"manager"
+)
+
+// Handler serves the files of an image over HTTP straight from its mapping.
+// Range requests and conditional requests are handled by http.ServeContent.
+// Symlinks are followed inside the image and directories are listed.
+type Handler struct {
+	// Img is the image being served
+	Img *reader.Image
+}
+
+// NewHandler creates a Handler serving img
+func NewHandler(img *reader.Image) *Handler {
+	return &Handler{Img: img}
+}
+
+// ServeHTTP implements http.Handler
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	p := reader.Clean(r.URL.Path)
+	e, err := h.Img.Resolve(p)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch e.Type {
+	case manager.Directory:
+		// Like http.FileServer, directories are addressed with a trailing slash
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			redirect(w, r, path.Base(r.URL.Path)+"/")
+			return
+		}
+		if index, err := h.Img.Resolve(path.Join(p, "index.html")); err == nil && index.Type == manager.RegularFile {
+			h.serveFile(w, r, index)
+			return
+		}
+		h.serveDir(w, r, e)
+	case manager.RegularFile:
+		h.serveFile(w, r, e)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveFile serves the content of the regular file e
+func (h *Handler) serveFile(w http.ResponseWriter, r *http.Request, e reader.Entry) {
+	w.Header().Set("ETag", ETag(&e.FileMetadata))
+	http.ServeContent(w, r, e.Name, modTime(e.ModTime), h.Img.NewReader(&e.FileMetadata))
+}
+
+// serveDir lists the directory e
+func (h *Handler) serveDir(w http.ResponseWriter, r *http.Request, e reader.Entry) {
+	if t := modTime(e.ModTime); !t.IsZero() {
+		w.Header().Set("Last-Modified", t.UTC().Format(http.TimeFormat))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	fmt.Fprintf(w, "<pre>\n")
+	for _, c := range h.Img.Children(e.Path) {
+		if c.Type == manager.WhiteoutFile {
+			continue
+		}
+		name := c.Name
+		if c.Type == manager.Directory {
+			name += "/"
+		}
+		// The name may contain characters that are special in URLs
+		u := url.URL{Path: name}
+		fmt.Fprintf(w, "<a href=\"%v\">%v</a>\n", html.EscapeString(u.String()), html.EscapeString(name))
+	}
+	fmt.Fprintf(w, "</pre>\n")
+}
+
+// ETag returns the entity tag of a regular file: its checksum if stored,
+// otherwise its location in the image and its modification time
+func ETag(m *manager.FileMetadata) string {
+	if m.Checksum != "" {
+		return fmt.Sprintf("\"%v\"", m.Checksum)
+	}
+	return fmt.Sprintf("\"%x-%x-%x\"", m.Begin, m.End, m.ModTime)
+}
+
+// modTime converts a ModTime (ns since epoch) to a time. A ModTime of 0 gives the
+// zero time, so that no Last-Modified header is sent.
+func modTime(t int64) time.Time {
+	if t == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, t)
+}
+
+// redirect redirects to the relative URL target, keeping the query
+func redirect(w http.ResponseWriter, r *http.Request, target string) {
+	if q := r.URL.RawQuery; q != "" {
+		target += "?" + q
+	}
+	w.Header().Set("Location", target)
+	w.WriteHeader(http.StatusMovedPermanently)
+}
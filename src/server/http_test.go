@@ -0,0 +1,177 @@
+package server_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"fileio/reader"
+	"manager"
+	"server"
+	"stats"
+)
+
+// openImage writes the files (path -> content) and symlinks (path -> target) into
+// a temporary dir, creates an image from it and opens it. The caller removes dir.
+func openImage(t *testing.T, files map[string]string, links map[string]string) (img *reader.Image, dir string) {
+	dir, err := ioutil.TempDir("", "zar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := filepath.Join(dir, "root")
+	for p, content := range files {
+		fn := filepath.Join(root, p)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for p, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	z := &manager.ZarManager{
+		Alignment:  4096,
+		Statistics: &stats.ImgStats{},
+	}
+	fn := filepath.Join(dir, "test.img")
+	z.Writer.Init(fn)
+	z.WalkDir(root, root, 0, 0, true)
+	z.GenerateFilter()
+	z.WriteHeader()
+
+	img, err = reader.Open(fn)
+	if err != nil {
+		t.Fatalf("reader.Open(%v) failed: %v", fn, err)
+	}
+	return img, dir
+}
+
+// get performs a GET request against h with the given headers (name, value, ...)
+func get(h http.Handler, target string, headers ...string) *http.Response {
+	req := httptest.NewRequest("GET", target, nil)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Result()
+}
+
+func TestServeHTTP(t *testing.T) {
+	img, dir := openImage(t, map[string]string{
+		"Apples.txt":            "apples and more apples",
+		"Groceries/Bananas.txt": "bananas",
+	}, map[string]string{
+		"Groceries/link": "../Apples.txt",
+		"shop":           "Groceries",
+		"dangling":       "/nowhere",
+	})
+	defer os.RemoveAll(dir)
+	defer img.Close()
+
+	h := server.NewHandler(img)
+
+	resp := get(h, "/Apples.txt")
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "apples and more apples" {
+		t.Errorf("GET /Apples.txt = %v %q, expected 200 with the file content", resp.StatusCode, body)
+	}
+	if resp.ContentLength != int64(len("apples and more apples")) {
+		t.Errorf("GET /Apples.txt Content-Length = %v", resp.ContentLength)
+	}
+	if resp.Header.Get("Last-Modified") == "" {
+		t.Errorf("GET /Apples.txt has no Last-Modified header")
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatalf("GET /Apples.txt has no ETag header")
+	}
+
+	resp = get(h, "/Apples.txt", "Range", "bytes=4-6")
+	body, _ = ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusPartialContent || string(body) != "es " {
+		t.Errorf("GET /Apples.txt bytes=4-6 = %v %q, expected 206 \"es \"", resp.StatusCode, body)
+	}
+
+	resp = get(h, "/Apples.txt", "If-None-Match", etag)
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("GET /Apples.txt If-None-Match = %v, expected 304", resp.StatusCode)
+	}
+
+	// Symlinks are resolved inside the image, also in the middle of a path
+	for _, p := range []string{"/Groceries/link", "/shop/link"} {
+		resp = get(h, p)
+		body, _ = ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || string(body) != "apples and more apples" {
+			t.Errorf("GET %v = %v %q, expected the content of /Apples.txt", p, resp.StatusCode, body)
+		}
+	}
+
+	resp = get(h, "/Groceries")
+	if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "Groceries/" {
+		t.Errorf("GET /Groceries = %v Location %q, expected redirect to Groceries/", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	resp = get(h, "/Groceries/")
+	body, _ = ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `<a href="Bananas.txt">`) {
+		t.Errorf("GET /Groceries/ = %v %q, expected a listing with Bananas.txt", resp.StatusCode, body)
+	}
+
+	for _, p := range []string{"/Oranges.txt", "/dangling", "/Apples.txt/x"} {
+		if resp = get(h, p); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %v = %v, expected 404", p, resp.StatusCode)
+		}
+	}
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	img, dir := openImage(t, map[string]string{
+		"Apples.txt":            "apples",
+		"Groceries/Bananas.txt": "bananas",
+		"Groceries/Dates.txt":   "dates",
+	}, map[string]string{
+		"Groceries/link": "../Apples.txt",
+	})
+	defer os.RemoveAll(dir)
+	defer img.Close()
+
+	// The handler is shared by all requests, which fill the caches of the image
+	h := server.NewHandler(img)
+	want := map[string]string{
+		"/Apples.txt":            "apples",
+		"/Groceries/Bananas.txt": "bananas",
+		"/Groceries/Dates.txt":   "dates",
+		"/Groceries/link":        "apples",
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p, content := range want {
+				resp := get(h, p)
+				body, _ := ioutil.ReadAll(resp.Body)
+				if resp.StatusCode != http.StatusOK || string(body) != content {
+					t.Errorf("GET %v = %v %q, expected 200 %q", p, resp.StatusCode, body, content)
+				}
+			}
+			if resp := get(h, "/Groceries/"); resp.StatusCode != http.StatusOK {
+				t.Errorf("GET /Groceries/ = %v, expected 200", resp.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+}
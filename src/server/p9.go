@@ -0,0 +1,441 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"path"
+	"syscall"
+
+	"fileio/reader"
+	"manager"
+)
+
+// P9Server serves an image read-only over 9P2000.L. It supports walk, getattr,
+// readdir, read, readlink, statfs and xattr walks (the image stores no xattrs).
+// Requests that would modify the file system fail with EROFS.
+type P9Server struct {
+	// Img is the image being served
+	Img *reader.Image
+}
+
+// NewP9Server creates a P9Server for img
+func NewP9Server(img *reader.Image) *P9Server {
+	return &P9Server{Img: img}
+}
+
+// Serve accepts connections on l and serves each of them in its own goroutine.
+// It returns when l fails, e.g. because it was closed.
+func (s *P9Server) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := s.ServeConn(c); err != nil {
+				log.Printf("9p: %v", err)
+			}
+		}()
+	}
+}
+
+// ServeConn serves the requests of a single connection until it is closed
+func (s *P9Server) ServeConn(rw io.ReadWriteCloser) error {
+	defer rw.Close()
+
+	c := &p9Conn{
+		img:   s.Img,
+		msize: P9MaxMSize,
+		fids:  make(map[uint32]*p9Fid),
+	}
+	r := bufio.NewReader(rw)
+
+	for {
+		typ, tag, req, err := readMsg(r, c.msize)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		rtyp, resp, err := c.handle(typ, req)
+		if err == nil && req.err != nil {
+			err = syscall.EINVAL
+		}
+		if err != nil {
+			errno, ok := err.(syscall.Errno)
+			if !ok {
+				errno = syscall.EIO
+			}
+			rtyp, resp = rlerror, &p9Buf{}
+			resp.putU32(uint32(errno))
+		}
+
+		if err := writeMsg(rw, rtyp, tag, resp.b); err != nil {
+			return err
+		}
+	}
+}
+
+// p9Fid is the state of a fid of a connection
+type p9Fid struct {
+	// e is the entry the fid points at
+	e reader.Entry
+
+	// open is set once the fid was opened with lopen
+	open bool
+
+	// xattr is set for fids created by xattrwalk, reading them returns data
+	xattr bool
+	data  []byte
+}
+
+// p9Conn is the state of a single connection
+type p9Conn struct {
+	img   *reader.Image
+	msize uint32
+	fids  map[uint32]*p9Fid
+}
+
+// handle handles a request and returns the response type and body
+func (c *p9Conn) handle(typ uint8, req *p9Buf) (uint8, *p9Buf, error) {
+	resp := &p9Buf{}
+	switch typ {
+	case tversion:
+		return rversion, resp, c.version(req, resp)
+	case tattach:
+		return rattach, resp, c.attach(req, resp)
+	case twalk:
+		return rwalk, resp, c.walk(req, resp)
+	case tlopen:
+		return rlopen, resp, c.lopen(req, resp)
+	case tgetattr:
+		return rgetattr, resp, c.getattr(req, resp)
+	case treaddir:
+		return rreaddir, resp, c.readdir(req, resp)
+	case tread:
+		return rread, resp, c.read(req, resp)
+	case treadlink:
+		return rreadlink, resp, c.readlink(req, resp)
+	case txattrwalk:
+		return rxattrwalk, resp, c.xattrwalk(req, resp)
+	case tstatfs:
+		return rstatfs, resp, c.statfs(req, resp)
+	case tclunk:
+		delete(c.fids, req.u32())
+		return rclunk, resp, nil
+	case tremove:
+		// remove clunks the fid even if it fails
+		delete(c.fids, req.u32())
+		return 0, nil, syscall.EROFS
+	case tflush:
+		// Requests are answered in order, so there is nothing left to flush
+		return rflush, resp, nil
+	case tfsync:
+		return rfsync, resp, nil
+	case tlcreate, tsymlink, tmknod, trename, tsetattr, txattrcreate, tlink, tmkdir, trenameat, tunlinkat, twrite:
+		return 0, nil, syscall.EROFS
+	case tauth:
+		return 0, nil, syscall.EOPNOTSUPP
+	}
+	return 0, nil, syscall.ENOSYS
+}
+
+// version negotiates the message size and the protocol version.
+// It resets the connection.
+func (c *p9Conn) version(req *p9Buf, resp *p9Buf) error {
+	msize, version := req.u32(), req.str()
+	if msize < c.msize {
+		c.msize = msize
+	}
+	c.fids = make(map[uint32]*p9Fid)
+
+	resp.putU32(c.msize)
+	if version != P9Version {
+		resp.putStr("unknown")
+		return nil
+	}
+	resp.putStr(P9Version)
+	return nil
+}
+
+// attach creates a fid for the root of the image
+func (c *p9Conn) attach(req *p9Buf, resp *p9Buf) error {
+	fid := req.u32()
+	req.u32() // afid
+	req.str() // uname
+	req.str() // aname
+	req.u32() // n_uname
+
+	if _, ok := c.fids[fid]; ok {
+		return syscall.EBADF
+	}
+
+	root := c.img.Root()
+	c.fids[fid] = &p9Fid{e: root}
+	resp.putQid(c.qid(&root))
+	return nil
+}
+
+// walk walks newfid from fid along the given names
+func (c *p9Conn) walk(req *p9Buf, resp *p9Buf) error {
+	fid, newfid, n := req.u32(), req.u32(), int(req.u16())
+	if n > p9MaxWalks {
+		return syscall.EINVAL
+	}
+	names := make([]string, n)
+	for i := range names {
+		names[i] = req.str()
+	}
+
+	f, ok := c.fids[fid]
+	if !ok || f.open || f.xattr {
+		return syscall.EBADF
+	}
+	if _, ok := c.fids[newfid]; ok && newfid != fid {
+		return syscall.EBADF
+	}
+
+	e := f.e
+	var qids []P9Qid
+	for i, name := range names {
+		next, err := c.lookup(e, name)
+		if err != nil {
+			if i == 0 {
+				return err
+			}
+			// A partial walk returns the qids walked so far and does not create newfid
+			break
+		}
+		e = next
+		qids = append(qids, c.qid(&e))
+	}
+
+	if len(qids) == len(names) {
+		c.fids[newfid] = &p9Fid{e: e}
+	}
+
+	resp.putU16(uint16(len(qids)))
+	for _, q := range qids {
+		resp.putQid(q)
+	}
+	return nil
+}
+
+// lookup returns the entry name in the directory dir, without following symlinks
+func (c *p9Conn) lookup(dir reader.Entry, name string) (reader.Entry, error) {
+	if dir.Type != manager.Directory {
+		return reader.Entry{}, syscall.ENOTDIR
+	}
+
+	switch name {
+	case ".":
+		return dir, nil
+	case "..":
+		return c.img.Parent(dir), nil
+	}
+
+	e, ok := c.img.Lookup(path.Join(dir.Path, name))
+	if !ok {
+		return reader.Entry{}, syscall.ENOENT
+	}
+	return e, nil
+}
+
+// lopen opens a fid for reading
+func (c *p9Conn) lopen(req *p9Buf, resp *p9Buf) error {
+	fid, flags := req.u32(), req.u32()
+
+	f, ok := c.fids[fid]
+	if !ok || f.open || f.xattr {
+		return syscall.EBADF
+	}
+	if flags&syscall.O_ACCMODE != syscall.O_RDONLY || flags&(syscall.O_TRUNC|syscall.O_CREAT) != 0 {
+		return syscall.EROFS
+	}
+
+	f.open = true
+	resp.putQid(c.qid(&f.e))
+	resp.putU32(c.msize - p9IOHdrSz)
+	return nil
+}
+
+// getattr returns the attributes of a fid
+func (c *p9Conn) getattr(req *p9Buf, resp *p9Buf) error {
+	fid := req.u32()
+	req.u64() // request_mask, all basic attributes are always returned
+
+	f, ok := c.fids[fid]
+	if !ok || f.xattr {
+		return syscall.EBADF
+	}
+	e := &f.e
+
+	size := uint64(e.Size())
+	if e.Type == manager.Symlink {
+		size = uint64(len(e.Link))
+	}
+	sec, nsec := uint64(e.ModTime/1e9), uint64(e.ModTime%1e9)
+
+	resp.putU64(P9GetattrBasic)
+	resp.putQid(c.qid(e))
+	resp.putU32(e.UnixMode())
+	resp.putU32(0) // uid
+	resp.putU32(0) // gid
+	resp.putU64(c.img.Nlink(e))
+	resp.putU64(0) // rdev, whiteouts are 0/0 character devices
+	resp.putU64(size)
+	resp.putU64(p9BlkSize)
+	resp.putU64((size + 511) / 512)
+	for i := 0; i < 3; i++ { // atime, mtime and ctime
+		resp.putU64(sec)
+		resp.putU64(nsec)
+	}
+	for i := 0; i < 4; i++ { // btime, gen and data_version are not supported
+		resp.putU64(0)
+	}
+	return nil
+}
+
+// readdir returns the entries of an open directory starting at the cookie offset,
+// see reader.Image.ReadDir
+func (c *p9Conn) readdir(req *p9Buf, resp *p9Buf) error {
+	fid, offset, count := req.u32(), req.u64(), req.u32()
+
+	f, ok := c.fids[fid]
+	if !ok || !f.open {
+		return syscall.EBADF
+	}
+	if max := c.msize - p9IOHdrSz; count > max {
+		count = max
+	}
+
+	// Only the entries that can fit in count are read, names being at least one
+	// byte, so that paging through a large directory does not list it every time.
+	// ReadDir reads them all for n = 0.
+	n := int(count) / direntSize(".")
+	if n == 0 {
+		n = 1
+	}
+	dirents, _, err := c.img.ReadDir(f.e.Path, offset, n)
+	if err != nil {
+		return err
+	}
+
+	data := &p9Buf{}
+	for i := range dirents {
+		d := &dirents[i]
+		if len(data.b)+direntSize(d.Name) > int(count) {
+			break
+		}
+		data.putQid(c.qid(&d.Entry))
+		data.putU64(d.Off)
+		data.putU8(d.Type)
+		data.putStr(d.Name)
+	}
+
+	resp.putU32(uint32(len(data.b)))
+	resp.b = append(resp.b, data.b...)
+	return nil
+}
+
+// read reads from an open file or an xattr fid
+func (c *p9Conn) read(req *p9Buf, resp *p9Buf) error {
+	fid, offset, count := req.u32(), req.u64(), req.u32()
+
+	f, ok := c.fids[fid]
+	if !ok || !f.open && !f.xattr {
+		return syscall.EBADF
+	}
+
+	if max := c.msize - p9IOHdrSz; count > max {
+		count = max
+	}
+
+	data := f.data
+	if !f.xattr {
+		if f.e.Type == manager.Directory {
+			return syscall.EISDIR
+		}
+		// Only the requested range is read, compressed files decompress the chunks holding it
+		buf := make([]byte, count)
+		n, err := c.img.ReadAt(&f.e.FileMetadata, buf, int64(offset))
+		if err != nil && err != io.EOF {
+			return syscall.EIO
+		}
+		data, offset = buf[:n], 0
+	}
+
+	if offset > uint64(len(data)) {
+		offset = uint64(len(data))
+	}
+	end := offset + uint64(count)
+	if end > uint64(len(data)) {
+		end = uint64(len(data))
+	}
+
+	resp.putU32(uint32(end - offset))
+	resp.b = append(resp.b, data[offset:end]...)
+	return nil
+}
+
+// readlink returns the target of a symlink
+func (c *p9Conn) readlink(req *p9Buf, resp *p9Buf) error {
+	f, ok := c.fids[req.u32()]
+	if !ok || f.xattr {
+		return syscall.EBADF
+	}
+	if f.e.Type != manager.Symlink {
+		return syscall.EINVAL
+	}
+
+	resp.putStr(f.e.Link)
+	return nil
+}
+
+// xattrwalk creates a fid to read an extended attribute, or the list of them
+// for an empty name. The image stores no extended attributes.
+func (c *p9Conn) xattrwalk(req *p9Buf, resp *p9Buf) error {
+	fid, newfid, name := req.u32(), req.u32(), req.str()
+
+	f, ok := c.fids[fid]
+	if !ok || f.xattr {
+		return syscall.EBADF
+	}
+	if _, ok := c.fids[newfid]; ok && newfid != fid {
+		return syscall.EBADF
+	}
+	if name != "" {
+		return syscall.ENODATA
+	}
+
+	c.fids[newfid] = &p9Fid{e: f.e, xattr: true}
+	resp.putU64(0)
+	return nil
+}
+
+// statfs returns the file system statistics of the image
+func (c *p9Conn) statfs(req *p9Buf, resp *p9Buf) error {
+	if _, ok := c.fids[req.u32()]; !ok {
+		return syscall.EBADF
+	}
+
+	resp.putU32(p9Magic)
+	resp.putU32(p9BlkSize)
+	resp.putU64(uint64(len(c.img.Data)+p9BlkSize-1) / p9BlkSize) // blocks
+	resp.putU64(0)                                               // bfree
+	resp.putU64(0)                                               // bavail
+	resp.putU64(uint64(len(c.img.Entries()) + 1))                // files
+	resp.putU64(0)                                               // ffree
+	resp.putU64(0)                                               // fsid
+	resp.putU32(255)                                             // namelen
+	return nil
+}
+
+// qid returns the qid of an entry. The path is the inode number of the entry.
+func (c *p9Conn) qid(e *reader.Entry) P9Qid {
+	return P9Qid{Type: qidType(&e.FileMetadata), Path: c.img.Ino(e)}
+}
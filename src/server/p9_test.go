@@ -0,0 +1,169 @@
+package server_test
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"testing"
+
+	"server"
+)
+
+// dialP9 serves img on a unix socket in dir and connects a client to it
+func dialP9(t *testing.T, srv *server.P9Server, dir string) (*server.P9Client, net.Listener) {
+	sock := filepath.Join(dir, "zar.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+
+	c, err := server.DialP9("unix", sock)
+	if err != nil {
+		l.Close()
+		t.Fatalf("DialP9 failed: %v", err)
+	}
+	return c, l
+}
+
+func TestP9Server(t *testing.T) {
+	img, dir := openImage(t, map[string]string{
+		"Apples.txt":            "apples and more apples",
+		"Groceries/Bananas.txt": "bananas",
+		"Groceries/Cherries":    "cherries",
+		"Groceries/Dates":       "dates",
+	}, map[string]string{
+		"Groceries/link": "../Apples.txt",
+	})
+	defer os.RemoveAll(dir)
+	defer img.Close()
+
+	c, l := dialP9(t, server.NewP9Server(img), dir)
+	defer l.Close()
+	defer c.Close()
+
+	const root, file, grocs, link, xattr, tmp = 1, 2, 3, 4, 5, 6
+
+	rootQid, err := c.Attach(root)
+	if err != nil || rootQid.Type != server.P9QTDir {
+		t.Fatalf("Attach = %+v, %v, expected a directory", rootQid, err)
+	}
+
+	// walk
+	qids, err := c.Walk(root, file, "Apples.txt")
+	if err != nil || len(qids) != 1 || qids[0].Type != server.P9QTFile {
+		t.Fatalf("Walk(Apples.txt) = %+v, %v", qids, err)
+	}
+	if _, err := c.Walk(root, tmp, "Oranges.txt"); err != syscall.ENOENT {
+		t.Errorf("Walk(Oranges.txt) error = %v, expected ENOENT", err)
+	}
+	if qids, err := c.Walk(root, tmp, "Groceries", "Oranges"); err != nil || len(qids) != 1 {
+		t.Errorf("partial Walk(Groceries/Oranges) = %+v, %v, expected 1 qid", qids, err)
+	}
+	if _, err := c.Getattr(tmp); err != syscall.EBADF {
+		t.Errorf("partial walk created newfid, Getattr error = %v", err)
+	}
+	if qids, err := c.Walk(root, tmp, "Groceries", ".."); err != nil || len(qids) != 2 || qids[1] != rootQid {
+		t.Errorf("Walk(Groceries/..) = %+v, %v, expected to end at the root", qids, err)
+	}
+	c.Clunk(tmp)
+
+	// getattr
+	a, err := c.Getattr(file)
+	if err != nil {
+		t.Fatalf("Getattr(Apples.txt) failed: %v", err)
+	}
+	if a.Size != uint64(len("apples and more apples")) || a.Mode&syscall.S_IFMT != syscall.S_IFREG || a.Mode&0777 != 0644 {
+		t.Errorf("Getattr(Apples.txt) = size %v mode %o", a.Size, a.Mode)
+	}
+	if a.Qid != qids[0] || a.MtimeSec == 0 {
+		t.Errorf("Getattr(Apples.txt) = qid %+v mtime %v", a.Qid, a.MtimeSec)
+	}
+
+	// read
+	if _, _, err := c.Lopen(file, syscall.O_RDWR); err != syscall.EROFS {
+		t.Errorf("Lopen(O_RDWR) error = %v, expected EROFS", err)
+	}
+	if _, iounit, err := c.Lopen(file, syscall.O_RDONLY); err != nil || iounit == 0 {
+		t.Fatalf("Lopen = iounit %v, %v", iounit, err)
+	}
+	if data, err := c.Read(file, 4, 3); err != nil || string(data) != "es " {
+		t.Errorf("Read(4, 3) = %q, %v, expected \"es \"", data, err)
+	}
+	if data, err := c.Read(file, 100, 10); err != nil || len(data) != 0 {
+		t.Errorf("Read past the end = %q, %v, expected no data", data, err)
+	}
+
+	// readlink
+	if _, err := c.Walk(root, link, "Groceries", "link"); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := c.Readlink(link); err != nil || target != "../Apples.txt" {
+		t.Errorf("Readlink = %q, %v", target, err)
+	}
+	if _, err := c.Readlink(file); err != syscall.EINVAL {
+		t.Errorf("Readlink(file) error = %v, expected EINVAL", err)
+	}
+
+	// readdir, paged so that every call returns one entry
+	if _, err := c.Walk(root, grocs, "Groceries"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.Lopen(grocs, syscall.O_RDONLY|syscall.O_DIRECTORY); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	var offset uint64
+	for {
+		dirents, err := c.Readdir(grocs, offset, 40)
+		if err != nil {
+			t.Fatalf("Readdir(%v) failed: %v", offset, err)
+		}
+		if len(dirents) == 0 {
+			break
+		}
+		if len(dirents) != 1 {
+			t.Fatalf("Readdir(%v, 40) returned %v entries, expected 1", offset, len(dirents))
+		}
+		names = append(names, dirents[0].Name)
+		offset = dirents[0].Offset
+	}
+	sort.Strings(names)
+	expected := []string{".", "..", "Bananas.txt", "Cherries", "Dates", "link"}
+	if len(names) != len(expected) {
+		t.Fatalf("Readdir = %v, expected %v", names, expected)
+	}
+	for i := range names {
+		if names[i] != expected[i] {
+			t.Fatalf("Readdir = %v, expected %v", names, expected)
+		}
+	}
+	if dirents, err := c.Readdir(grocs, 0, 4096); err != nil || len(dirents) != len(expected) {
+		t.Errorf("Readdir(0, 4096) = %v entries, %v", len(dirents), err)
+	}
+	// "." and ".." take 25 and 26 bytes
+	if dirents, err := c.Readdir(grocs, 0, 51); err != nil || len(dirents) != 2 {
+		t.Errorf("Readdir(0, 51) = %v entries, %v, expected 2", len(dirents), err)
+	}
+	if _, err := c.Read(grocs, 0, 10); err != syscall.EISDIR {
+		t.Errorf("Read(dir) error = %v, expected EISDIR", err)
+	}
+
+	// xattr
+	if size, err := c.Xattrwalk(file, xattr, ""); err != nil || size != 0 {
+		t.Errorf("Xattrwalk(\"\") = %v, %v, expected an empty list", size, err)
+	}
+	if _, err := c.Xattrwalk(file, tmp, "user.x"); err != syscall.ENODATA {
+		t.Errorf("Xattrwalk(user.x) error = %v, expected ENODATA", err)
+	}
+
+	// the image is read-only
+	if err := c.Remove(file); err != syscall.EROFS {
+		t.Errorf("Remove error = %v, expected EROFS", err)
+	}
+	if _, err := c.Getattr(file); err != syscall.EBADF {
+		t.Errorf("Remove did not clunk the fid, Getattr error = %v", err)
+	}
+}
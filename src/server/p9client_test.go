@@ -0,0 +1,291 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// p9NoFid is the fid sent when no fid is given, e.g. as the afid of Tattach
+const p9NoFid = 0xffffffff
+
+// P9Dirent is a directory entry returned by readdir
+type P9Dirent struct {
+	Qid P9Qid
+
+	// Offset is the cookie to continue reading the directory after this entry
+	Offset uint64
+
+	// Type is the d_type of the entry (DT_REG, DT_DIR, ...)
+	Type uint8
+
+	Name string
+}
+
+// P9Attr holds the attributes returned by getattr
+type P9Attr struct {
+	Valid     uint64
+	Qid       P9Qid
+	Mode      uint32
+	UID       uint32
+	GID       uint32
+	Nlink     uint64
+	Rdev      uint64
+	Size      uint64
+	BlkSize   uint64
+	Blocks    uint64
+	AtimeSec  uint64
+	AtimeNsec uint64
+	MtimeSec  uint64
+	MtimeNsec uint64
+	CtimeSec  uint64
+	CtimeNsec uint64
+}
+
+// qid decodes a qid, which only the client receives
+func (p *p9Buf) qid() P9Qid {
+	return P9Qid{Type: p.u8(), Version: p.u32(), Path: p.u64()}
+}
+
+// P9Client is a minimal 9P2000.L client for the read-only subset served by
+// P9Server, used by the tests. It is in package server to build on the message
+// encoding, but only compiled for tests. Requests are sent one at a time. Errors
+// returned by the server are syscall.Errno values.
+type P9Client struct {
+	conn  net.Conn
+	r     *bufio.Reader
+	msize uint32
+	tag   uint16
+}
+
+// DialP9 connects to a 9P2000.L server and negotiates the version
+func DialP9(network, addr string) (*P9Client, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &P9Client{conn: conn, r: bufio.NewReader(conn), msize: P9MaxMSize}
+
+	req := &p9Buf{}
+	req.putU32(c.msize)
+	req.putStr(P9Version)
+	resp, err := c.rpcTag(tversion, p9NoTag, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	msize, version := resp.u32(), resp.str()
+	if version != P9Version {
+		conn.Close()
+		return nil, fmt.Errorf("9p: server speaks %q", version)
+	}
+	c.msize = msize
+	return c, nil
+}
+
+// Close closes the connection
+func (c *P9Client) Close() error {
+	return c.conn.Close()
+}
+
+// MSize returns the negotiated message size
+func (c *P9Client) MSize() uint32 {
+	return c.msize
+}
+
+// Attach attaches fid to the root of the served tree
+func (c *P9Client) Attach(fid uint32) (P9Qid, error) {
+	req := &p9Buf{}
+	req.putU32(fid)
+	req.putU32(p9NoFid)
+	req.putStr("")
+	req.putStr("")
+	req.putU32(p9NoFid)
+	resp, err := c.rpc(tattach, req)
+	if err != nil {
+		return P9Qid{}, err
+	}
+	return resp.qid(), resp.err
+}
+
+// Walk walks newfid from fid along names. It returns the qids of the walked
+// elements, which are fewer than names if the walk stopped early.
+func (c *P9Client) Walk(fid, newfid uint32, names ...string) ([]P9Qid, error) {
+	req := &p9Buf{}
+	req.putU32(fid)
+	req.putU32(newfid)
+	req.putU16(uint16(len(names)))
+	for _, name := range names {
+		req.putStr(name)
+	}
+	resp, err := c.rpc(twalk, req)
+	if err != nil {
+		return nil, err
+	}
+	qids := make([]P9Qid, resp.u16())
+	for i := range qids {
+		qids[i] = resp.qid()
+	}
+	return qids, resp.err
+}
+
+// Lopen opens fid with the given open flags and returns its qid and iounit
+func (c *P9Client) Lopen(fid, flags uint32) (P9Qid, uint32, error) {
+	req := &p9Buf{}
+	req.putU32(fid)
+	req.putU32(flags)
+	resp, err := c.rpc(tlopen, req)
+	if err != nil {
+		return P9Qid{}, 0, err
+	}
+	return resp.qid(), resp.u32(), resp.err
+}
+
+// Read reads up to count bytes of an open fid at offset
+func (c *P9Client) Read(fid uint32, offset uint64, count uint32) ([]byte, error) {
+	req := &p9Buf{}
+	req.putU32(fid)
+	req.putU64(offset)
+	req.putU32(count)
+	resp, err := c.rpc(tread, req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.take(int(resp.u32())), resp.err
+}
+
+// Readdir reads the entries of an open directory that fit in count bytes,
+// starting at the cookie offset (0 for the first entry)
+func (c *P9Client) Readdir(fid uint32, offset uint64, count uint32) ([]P9Dirent, error) {
+	req := &p9Buf{}
+	req.putU32(fid)
+	req.putU64(offset)
+	req.putU32(count)
+	resp, err := c.rpc(treaddir, req)
+	if err != nil {
+		return nil, err
+	}
+
+	data := &p9Buf{b: resp.take(int(resp.u32()))}
+	var dirents []P9Dirent
+	for len(data.b) > 0 && data.err == nil {
+		dirents = append(dirents, P9Dirent{
+			Qid:    data.qid(),
+			Offset: data.u64(),
+			Type:   data.u8(),
+			Name:   data.str(),
+		})
+	}
+	if resp.err != nil {
+		return nil, resp.err
+	}
+	return dirents, data.err
+}
+
+// Getattr returns the attributes of fid
+func (c *P9Client) Getattr(fid uint32) (P9Attr, error) {
+	req := &p9Buf{}
+	req.putU32(fid)
+	req.putU64(P9GetattrBasic)
+	resp, err := c.rpc(tgetattr, req)
+	if err != nil {
+		return P9Attr{}, err
+	}
+	a := P9Attr{
+		Valid:     resp.u64(),
+		Qid:       resp.qid(),
+		Mode:      resp.u32(),
+		UID:       resp.u32(),
+		GID:       resp.u32(),
+		Nlink:     resp.u64(),
+		Rdev:      resp.u64(),
+		Size:      resp.u64(),
+		BlkSize:   resp.u64(),
+		Blocks:    resp.u64(),
+		AtimeSec:  resp.u64(),
+		AtimeNsec: resp.u64(),
+		MtimeSec:  resp.u64(),
+		MtimeNsec: resp.u64(),
+		CtimeSec:  resp.u64(),
+		CtimeNsec: resp.u64(),
+	}
+	return a, resp.err
+}
+
+// Readlink returns the target of the symlink fid
+func (c *P9Client) Readlink(fid uint32) (string, error) {
+	req := &p9Buf{}
+	req.putU32(fid)
+	resp, err := c.rpc(treadlink, req)
+	if err != nil {
+		return "", err
+	}
+	return resp.str(), resp.err
+}
+
+// Xattrwalk creates newfid to read the extended attribute name of fid, or the
+// list of attribute names if name is empty. It returns the size of the value.
+func (c *P9Client) Xattrwalk(fid, newfid uint32, name string) (uint64, error) {
+	req := &p9Buf{}
+	req.putU32(fid)
+	req.putU32(newfid)
+	req.putStr(name)
+	resp, err := c.rpc(txattrwalk, req)
+	if err != nil {
+		return 0, err
+	}
+	return resp.u64(), resp.err
+}
+
+// Clunk releases fid
+func (c *P9Client) Clunk(fid uint32) error {
+	req := &p9Buf{}
+	req.putU32(fid)
+	_, err := c.rpc(tclunk, req)
+	return err
+}
+
+// Remove removes the file of fid and releases fid
+func (c *P9Client) Remove(fid uint32) error {
+	req := &p9Buf{}
+	req.putU32(fid)
+	_, err := c.rpc(tremove, req)
+	return err
+}
+
+// rpc sends a request with the next tag and waits for its response
+func (c *P9Client) rpc(typ uint8, req *p9Buf) (*p9Buf, error) {
+	c.tag++
+	if c.tag == p9NoTag {
+		c.tag = 0
+	}
+	return c.rpcTag(typ, c.tag, req)
+}
+
+func (c *P9Client) rpcTag(typ uint8, tag uint16, req *p9Buf) (*p9Buf, error) {
+	if err := writeMsg(c.conn, typ, tag, req.b); err != nil {
+		return nil, err
+	}
+
+	rtyp, rtag, resp, err := readMsg(c.r, c.msize)
+	if err != nil {
+		return nil, err
+	}
+	if rtag != tag {
+		return nil, fmt.Errorf("9p: response tag %v for request tag %v", rtag, tag)
+	}
+
+	switch rtyp {
+	case rlerror:
+		errno := resp.u32()
+		if resp.err != nil {
+			return nil, resp.err
+		}
+		return nil, syscall.Errno(errno)
+	case typ + 1:
+		return resp, nil
+	}
+	return nil, fmt.Errorf("9p: unexpected response type %v to request type %v", rtyp, typ)
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"manager"
+)
+
+const (
+	// P9Version is the 9P dialect spoken by P9Server
+	P9Version = "9P2000.L"
+
+	// P9MaxMSize is the largest message size negotiated by P9Server
+	P9MaxMSize = 1 << 20
+
+	p9NoTag    = 0xffff
+	p9IOHdrSz  = 24         // Room for the header of Tread, Rread, Treaddir and Rreaddir
+	p9Magic    = 0x01021997 // V9FS_MAGIC reported by statfs
+	p9BlkSize  = 4096
+	p9MaxWalks = 16
+)
+
+// 9P2000.L message types
+const (
+	rlerror      = 7
+	tstatfs      = 8
+	rstatfs      = 9
+	tlopen       = 12
+	rlopen       = 13
+	tlcreate     = 14
+	tsymlink     = 16
+	tmknod       = 18
+	trename      = 20
+	treadlink    = 22
+	rreadlink    = 23
+	tgetattr     = 24
+	rgetattr     = 25
+	tsetattr     = 26
+	txattrwalk   = 30
+	rxattrwalk   = 31
+	txattrcreate = 32
+	treaddir     = 40
+	rreaddir     = 41
+	tfsync       = 50
+	rfsync       = 51
+	tlink        = 70
+	tmkdir       = 72
+	trenameat    = 74
+	tunlinkat    = 76
+	tversion     = 100
+	rversion     = 101
+	tauth        = 102
+	tattach      = 104
+	rattach      = 105
+	tflush       = 108
+	rflush       = 109
+	twalk        = 110
+	rwalk        = 111
+	tread        = 116
+	rread        = 117
+	twrite       = 118
+	tclunk       = 120
+	rclunk       = 121
+	tremove      = 122
+)
+
+// Qid types
+const (
+	P9QTDir     = 0x80
+	P9QTSymlink = 0x02
+	P9QTFile    = 0x00
+)
+
+// P9GetattrBasic is the getattr request mask of all basic attributes
+const P9GetattrBasic = 0x000007ff
+
+// P9Qid is the server's unique identification of a file
+type P9Qid struct {
+	Type    uint8
+	Version uint32
+	Path    uint64
+}
+
+// p9Buf encodes and decodes the little endian fields of a 9P message. Reads
+// consume from the front, writes append. The first decoding error is kept in err.
+type p9Buf struct {
+	b   []byte
+	err error
+}
+
+func (p *p9Buf) take(n int) []byte {
+	if p.err != nil {
+		return make([]byte, n)
+	}
+	if len(p.b) < n {
+		p.err = errors.New("9p: short message")
+		return make([]byte, n)
+	}
+	v := p.b[:n]
+	p.b = p.b[n:]
+	return v
+}
+
+func (p *p9Buf) u8() uint8   { return p.take(1)[0] }
+func (p *p9Buf) u16() uint16 { return binary.LittleEndian.Uint16(p.take(2)) }
+func (p *p9Buf) u32() uint32 { return binary.LittleEndian.Uint32(p.take(4)) }
+func (p *p9Buf) u64() uint64 { return binary.LittleEndian.Uint64(p.take(8)) }
+func (p *p9Buf) str() string { return string(p.take(int(p.u16()))) }
+
+func (p *p9Buf) putU8(v uint8) { p.b = append(p.b, v) }
+
+func (p *p9Buf) putU16(v uint16) {
+	p.b = append(p.b, 0, 0)
+	binary.LittleEndian.PutUint16(p.b[len(p.b)-2:], v)
+}
+
+func (p *p9Buf) putU32(v uint32) {
+	p.b = append(p.b, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(p.b[len(p.b)-4:], v)
+}
+
+func (p *p9Buf) putU64(v uint64) {
+	p.b = append(p.b, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint64(p.b[len(p.b)-8:], v)
+}
+
+func (p *p9Buf) putStr(s string) {
+	p.putU16(uint16(len(s)))
+	p.b = append(p.b, s...)
+}
+
+func (p *p9Buf) putQid(q P9Qid) {
+	p.putU8(q.Type)
+	p.putU32(q.Version)
+	p.putU64(q.Path)
+}
+
+// direntSize returns the encoded size of a directory entry named name
+func direntSize(name string) int {
+	return 13 + 8 + 1 + 2 + len(name)
+}
+
+// readMsg reads a message: size[4] type[1] tag[2] body
+func readMsg(r *bufio.Reader, msize uint32) (uint8, uint16, *p9Buf, error) {
+	var hdr [7]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, 0, nil, err
+	}
+
+	size := binary.LittleEndian.Uint32(hdr[:4])
+	if size < 7 || size > msize {
+		return 0, 0, nil, fmt.Errorf("9p: bad message size %v", size)
+	}
+
+	body := make([]byte, size-7)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, 0, nil, err
+	}
+
+	return hdr[4], binary.LittleEndian.Uint16(hdr[5:]), &p9Buf{b: body}, nil
+}
+
+// writeMsg writes a message: size[4] type[1] tag[2] body
+func writeMsg(w io.Writer, typ uint8, tag uint16, body []byte) error {
+	msg := &p9Buf{b: make([]byte, 0, 7+len(body))}
+	msg.putU32(uint32(7 + len(body)))
+	msg.putU8(typ)
+	msg.putU16(tag)
+	msg.b = append(msg.b, body...)
+
+	_, err := w.Write(msg.b)
+	return err
+}
+
+// qidType returns the qid type of an entry
+func qidType(m *manager.FileMetadata) uint8 {
+	switch m.Type {
+	case manager.Directory:
+		return P9QTDir
+	case manager.Symlink:
+		return P9QTSymlink
+	}
+	return P9QTFile
+}
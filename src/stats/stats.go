@@ -18,6 +18,34 @@ type ImgStats struct {
 
 	// NumDirs represents number of directories in image file
 	NumDirs uint64
+
+	// DataBytes is the size of the data region, including alignment padding
+	DataBytes int64
+
+	// AlignedBytes is the size the data region would have if the data of every
+	// file was aligned
+	AlignedBytes int64
+
+	// NumPacked is the number of small files packed without alignment
+	NumPacked uint64
+
+	// NumInline is the number of files whose content is stored in the metadata
+	NumInline uint64
+
+	// InlineBytes is the size of the content stored in the metadata
+	InlineBytes int64
+
+	// NumMappable is the number of ELF files placed so their segments can be mapped
+	NumMappable uint64
+
+	// NumCompressed is the number of files whose data is compressed
+	NumCompressed uint64
+
+	// RawCompressed is the size of the compressed files before compression
+	RawCompressed int64
+
+	// StoredCompressed is the size of the compressed data of the files
+	StoredCompressed int64
 }
 
 // AddFile increments NumFile in the ImgStats struct
@@ -34,3 +62,40 @@ func (s *ImgStats) AddSymLink() {
 func (s *ImgStats) AddDir() {
 	s.NumDirs++
 }
+
+// AddData accounts for the data of a file in the ImgStats struct
+//
+// parameter (taken)  : the bytes the file took in the data region, with padding
+// parameter (aligned): the bytes it would take if it was aligned
+// parameter (packed) : whether the file was packed without alignment
+func (s *ImgStats) AddData(taken int64, aligned int64, packed bool) {
+	s.DataBytes += taken
+	s.AlignedBytes += aligned
+	if packed {
+		s.NumPacked++
+	}
+}
+
+// AddInline accounts for a file whose content is stored in the metadata
+//
+// parameter (size): the size of the content
+func (s *ImgStats) AddInline(size int64) {
+	s.NumInline++
+	s.InlineBytes += size
+}
+
+// AddCompressed accounts for a file whose data is compressed
+//
+// parameter (raw)   : the size of the data before compression
+// parameter (stored): the size of the compressed data
+func (s *ImgStats) AddCompressed(raw int64, stored int64) {
+	s.NumCompressed++
+	s.RawCompressed += raw
+	s.StoredCompressed += stored
+}
+
+// PackedSaved returns the bytes saved by packing small files compared to aligning
+// the data of every file
+func (s *ImgStats) PackedSaved() int64 {
+	return s.AlignedBytes - s.DataBytes
+}
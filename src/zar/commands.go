@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"fileio/reader"
+)
+
+// commands maps the name of a subcommand (e.g. "zar ls") to its implementation.
+// Each command parses its own flags from args and returns the exit code.
+var commands = map[string]func(args []string) int{
+	"ls":       lsCmd,
+	"info":     infoCmd,
+	"verify":   verifyCmd,
+	"diff":     diffCmd,
+	"find":     findCmd,
+	"du":       duCmd,
+	"repack":   repackCmd,
+	"merge":    mergeCmd,
+	"serve":    serveCmd,
+	"serve-9p": serve9pCmd,
+}
+
+// newFlagSet creates the flag set of a subcommand with a usage line
+//
+// parameter (name)	: name of the subcommand
+// parameter (synopsis)	: arguments following the flags, e.g. "img [path]"
+func newFlagSet(name string, synopsis string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: zar %v [flags] %v\n", name, synopsis)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// openImage opens the image file fn and reports failures on stderr
+func openImage(fn string) (*reader.Image, bool) {
+	img, err := reader.Open(fn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "zar: can't open image %v: %v\n", fn, err)
+		return nil, false
+	}
+	return img, true
+}
+
+// writeJSON writes v as indented JSON to stdout
+func writeJSON(v interface{}) error {
+	e := json.NewEncoder(os.Stdout)
+	e.SetIndent("", "  ")
+	return e.Encode(v)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"fileio/reader"
+)
+
+// diffCmd compares two images entry by entry. Like diff(1) it exits with 0 if
+// the images are the same, 1 if they differ and 2 on trouble.
+//
+// usage: zar diff [-json] [-ignore-mtime] a.img b.img
+func diffCmd(args []string) int {
+	fs := newFlagSet("diff", "a.img b.img")
+	jsonOut := fs.Bool("json", false, "output JSON")
+	ignoreModTime := fs.Bool("ignore-mtime", false, "do not compare modification times")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+
+	a, ok := openImage(fs.Arg(0))
+	if !ok {
+		return 2
+	}
+	defer a.Close()
+
+	b, ok := openImage(fs.Arg(1))
+	if !ok {
+		return 2
+	}
+	defer b.Close()
+
+	changes := reader.Diff(a, b, reader.DiffOptions{IgnoreModTime: *ignoreModTime})
+
+	if *jsonOut {
+		if changes == nil {
+			changes = []reader.Change{}
+		}
+		if err := writeJSON(changes); err != nil {
+			fmt.Fprintf(os.Stderr, "zar diff: %v\n", err)
+			return 2
+		}
+	} else {
+		for _, c := range changes {
+			switch c.Kind {
+			case reader.Added:
+				fmt.Printf("A %v\n", c.Path)
+			case reader.Removed:
+				fmt.Printf("D %v\n", c.Path)
+			case reader.Modified:
+				fmt.Printf("M %v (%v)\n", c.Path, strings.Join(c.Fields, ", "))
+			}
+		}
+	}
+
+	if len(changes) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"fileio/reader"
+	"manager"
+)
+
+// duCmd reports the space taken by each directory of an image
+//
+// usage: zar du [-d depth] [-sort taken|logical|files|path] [-json] img [path]
+func duCmd(args []string) int {
+	fs := newFlagSet("du", "img [path]")
+	depth := fs.Int("d", -1, "only report directories up to this depth below path, -1 for all")
+	sortBy := fs.String("sort", "taken", "sort by taken, logical, files or path")
+	jsonOut := fs.Bool("json", false, "output JSON")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		return 2
+	}
+
+	less, ok := duSorts[*sortBy]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "zar du: unknown sort %q\n", *sortBy)
+		return 2
+	}
+
+	img, ok := openImage(fs.Arg(0))
+	if !ok {
+		return 1
+	}
+	defer img.Close()
+
+	root := reader.Clean(fs.Arg(1))
+	if root != "/" {
+		if e, found := img.Lookup(root); !found || e.Type != manager.Directory {
+			fmt.Fprintf(os.Stderr, "zar du: %v: no such directory\n", root)
+			return 1
+		}
+	}
+
+	dirs := img.DiskUsage(root, *depth)
+	sort.SliceStable(dirs, func(i, j int) bool { return less(dirs[i], dirs[j]) })
+
+	if *jsonOut {
+		if err := writeJSON(dirs); err != nil {
+			fmt.Fprintf(os.Stderr, "zar du: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "taken\tlogical\tpadding\tinline\tfiles\t\n")
+	for _, d := range dirs {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t  %v\n", d.Taken, d.Logical, d.Padding(), d.Inline, d.Files, d.Path)
+	}
+	w.Flush()
+
+	return 0
+}
+
+// duSorts are the orders "zar du" can sort directories by. Sizes sort largest first.
+var duSorts = map[string]func(a, b reader.DirUsage) bool{
+	"taken":   func(a, b reader.DirUsage) bool { return a.Taken > b.Taken },
+	"logical": func(a, b reader.DirUsage) bool { return a.Logical > b.Logical },
+	"files":   func(a, b reader.DirUsage) bool { return a.Files > b.Files },
+	"path":    func(a, b reader.DirUsage) bool { return a.Path < b.Path },
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"fileio/reader"
+)
+
+// multiFlag is a flag that may be given several times, e.g. "-size +1k -size -1M"
+type multiFlag []string
+
+// String implements flag.Value
+func (m *multiFlag) String() string {
+	return strings.Join(*m, ",")
+}
+
+// Set implements flag.Value
+func (m *multiFlag) Set(v string) error {
+	*m = append(*m, v)
+	return nil
+}
+
+// findCmd searches the metadata of an image with predicates similar to find(1).
+// All given predicates must match.
+//
+// usage: zar find [predicates] [-json|-print0] img [path]
+func findCmd(args []string) int {
+	fs := newFlagSet("find", "img [path]")
+	name := fs.String("name", "", "glob the base name must match")
+	pathGlob := fs.String("path", "", "glob the full path must match, \"*\" also matches \"/\"")
+	types := fs.String("type", "", "entry types, comma separated: f (file), d (dir), l (symlink), w (whiteout)")
+	var sizes, mtimes multiFlag
+	fs.Var(&sizes, "size", "size in bytes [+|-]N[k|M|G]: more than, less than or exactly N. May be repeated for ranges")
+	fs.Var(&mtimes, "mtime", "modified [+|-]N days ago: more than, less than or exactly N. May be repeated for ranges")
+	newer := fs.String("newer", "", "modified after the entry at this image path, or after this time (RFC3339 or 2006-01-02)")
+	perm := fs.String("perm", "", "permission bits in octal: exactly MODE, all of -MODE or any of /MODE, e.g. -4000 for setuid")
+	jsonOut := fs.Bool("json", false, "output JSON")
+	print0 := fs.Bool("print0", false, "separate paths by NUL instead of newline")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		return 2
+	}
+
+	img, ok := openImage(fs.Arg(0))
+	if !ok {
+		return 1
+	}
+	defer img.Close()
+
+	found, err := img.Find(fs.Arg(1), reader.Query{
+		Name:   *name,
+		Path:   *pathGlob,
+		Types:  *types,
+		Sizes:  sizes,
+		MTimes: mtimes,
+		Newer:  *newer,
+		Perm:   *perm,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "zar find: %v\n", err)
+		return 2
+	}
+
+	switch {
+	case *jsonOut:
+		out := []reader.ListEntry{}
+		for _, e := range found {
+			out = append(out, reader.NewListEntry(e, true))
+		}
+		if err := writeJSON(out); err != nil {
+			fmt.Fprintf(os.Stderr, "zar find: %v\n", err)
+			return 1
+		}
+	case *print0:
+		for _, e := range found {
+			fmt.Printf("%v\x00", e.Path)
+		}
+	default:
+		for _, e := range found {
+			fmt.Println(e.Path)
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"fileio/reader"
+)
+
+// infoCmd reports the sections and layout of an image
+//
+// usage: zar info [-json] img
+func infoCmd(args []string) int {
+	fs := newFlagSet("info", "img")
+	jsonOut := fs.Bool("json", false, "output JSON")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	img, ok := openImage(fs.Arg(0))
+	if !ok {
+		return 1
+	}
+	defer img.Close()
+
+	info := img.Info(fs.Arg(0))
+
+	if *jsonOut {
+		if err := writeJSON(info); err != nil {
+			fmt.Fprintf(os.Stderr, "zar info: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	printImageInfo(info)
+	return 0
+}
+
+// printImageInfo prints the layout report as text
+func printImageInfo(info reader.ImageInfo) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(w, "image:\t%v (%v bytes)\n", info.Image, info.Size)
+	fmt.Fprintf(w, "format version:\t%v\n", info.Version)
+	switch {
+	case info.Alignment > 0:
+		fmt.Fprintf(w, "alignment:\t%v bytes\n", info.Alignment)
+	case info.Version < 2:
+		fmt.Fprintf(w, "alignment:\tnot recorded\n")
+	default:
+		fmt.Fprintf(w, "alignment:\tnone\n")
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintf(w, "section\toffset\tsize\n")
+	fmt.Fprintf(w, "data\t%v\t%v\n", info.Data.Offset, info.Data.Size)
+	fmt.Fprintf(w, "metadata (header)\t%v\t%v\n", info.Metadata.Offset, info.Metadata.Size)
+	fmt.Fprintf(w, "filter\t%v\t%v\n", info.Filter.Offset, info.Filter.Size)
+	if info.Index.Size > 0 {
+		fmt.Fprintf(w, "path index\t%v\t%v\n", info.Index.Offset, info.Index.Size)
+	}
+	fmt.Fprintf(w, "footer\t%v\t%v\n", info.Footer.Offset, info.Footer.Size)
+	fmt.Fprintln(w)
+
+	f := info.Filter
+	fmt.Fprintf(w, "filter:\t%v (active: %v), %v bits, %v hashes, %v elements, fp prob %v\n",
+		f.Name, f.Active, f.Bits, f.Hashes, f.Elements, f.FPProb)
+	e := info.Entries
+	fmt.Fprintf(w, "entries:\t%v files, %v dirs, %v symlinks, %v whiteouts\n",
+		e.Files, e.Dirs, e.Symlinks, e.Whiteouts)
+	fmt.Fprintf(w, "file data:\t%v bytes\n", info.FileBytes)
+	fmt.Fprintf(w, "padding:\t%v bytes (%.1f%% of data region)\n", info.Padding, percent(info.Padding, info.Data.Size))
+	if info.Version >= 10 {
+		fmt.Fprintf(w, "aligned files:\t%v\n", info.Aligned)
+	}
+	if info.Version >= 11 {
+		fmt.Fprintf(w, "mappable ELF files:\t%v\n", info.Mappable)
+	}
+	if info.PackThreshold > 0 {
+		fmt.Fprintf(w, "packed:\t%v files below %v bytes, %v bytes saved over aligning every file\n",
+			info.Packed, info.PackThreshold, info.PackSaved)
+	}
+	if info.Compressed > 0 {
+		fmt.Fprintf(w, "compressed:\t%v files, %v bytes stored as %v (%.1f%%)\n",
+			info.Compressed, info.CompressedRaw, info.CompressedStored, percent(info.CompressedStored, info.CompressedRaw))
+	}
+	if info.SectionCodec != "" {
+		stored := info.Metadata.Size + info.Filter.Size
+		fmt.Fprintf(w, "sections:\tmetadata and filter compressed with %v, %v bytes stored as %v (%.1f%%)\n",
+			info.SectionCodec, info.SectionRaw, stored, percent(stored, info.SectionRaw))
+	}
+	if info.InlineLimit > 0 {
+		fmt.Fprintf(w, "inline:\t%v files up to %v bytes, %v bytes in the metadata\n",
+			info.InlineFiles, info.InlineLimit, info.InlineBytes)
+	}
+
+	w.Flush()
+}
+
+// percent returns part as a percentage of total
+func percent(part int64, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(part) / float64(total)
+}
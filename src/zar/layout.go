@@ -0,0 +1,201 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"codec"
+	"fileio/reader"
+	"fileio/writer"
+	"filter"
+	"manager"
+	"policy"
+	"stats"
+)
+
+// layoutFlags are the flags controlling the layout of a written image. They are
+// shared by write mode and the commands that rewrite images (e.g. repack).
+type layoutFlags struct {
+	fs *flag.FlagSet
+
+	pageAlign *bool
+	align     *int64
+	packSmall *int64
+	inline    *int64
+	policy    *string
+	elf       *bool
+	compress  *string
+	chunkSize *int64
+	metaCodec *string
+	checksum  *bool
+	dedup     *bool
+	fpProb    *float64
+	keepOrder *bool
+
+	// alignPolicy is the policy loaded from -policy by check, or the alignment of
+	// each file of the source image taken by inherit
+	alignPolicy manager.AlignPolicy
+}
+
+// addLayoutFlags registers the layout flags on fs
+func addLayoutFlags(fs *flag.FlagSet) *layoutFlags {
+	return &layoutFlags{
+		fs:        fs,
+		pageAlign: fs.Bool("pagealign", false, "align the data of files to the page size of the host (same as -align=<page size>)"),
+		align:     fs.Int64("align", 0, "align the data of files to `N` bytes, a power of two (e.g. 512, 4096, 16384, 2097152)"),
+		packSmall: fs.Int64("packsmall", 0, "pack files smaller than `N` bytes together without alignment, larger files stay aligned"),
+		policy:    fs.String("policy", "", "`file` with rules deciding the alignment of each file, see package policy"),
+		elf:       fs.Bool("elf", false, "place ELF executables and libraries so their segments can be mapped straight out of the image"),
+		compress:  fs.String("compress", "", "compress the data of files that are not aligned with `codec`: flate or gzip"),
+		chunkSize: fs.Int64("chunksize", manager.DefaultChunkSize, "compress files in chunks of `N` bytes, so reads only decompress the chunks they need"),
+		metaCodec: fs.String("compressmeta", "", "compress the metadata and filter sections with `codec`: flate or gzip"),
+		inline:    fs.Int64("inline", 0, "store the content of files up to `N` bytes in the metadata instead of the data region"),
+		checksum:  fs.Bool("checksum", false, "store the SHA-256 of each file"),
+		dedup:     fs.Bool("dedup", false, "store files with identical content only once"),
+		fpProb:    fs.Float64("fpprob", filter.DEFAULT_PROB, "false positive probability of the bloom filter"),
+		keepOrder: fs.Bool("keeporder", false, "keep entries in walk order instead of sorting each directory by name"),
+	}
+}
+
+// isSet returns whether the flag name was given on the command line
+func (l *layoutFlags) isSet(name string) bool {
+	set := false
+	l.fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// inherit takes the layout of img for every layout flag not given on the command line
+func (l *layoutFlags) inherit(img *reader.Image) {
+	if !l.isSet("pagealign") && !l.isSet("align") {
+		*l.pageAlign = false
+		*l.align = img.Footer.Alignment
+	}
+	if !l.isSet("packsmall") {
+		*l.packSmall = img.Footer.PackThreshold
+	}
+	// Files keep their alignment unless the alignment flags are given
+	if l.keepsAlignment(img) {
+		l.alignPolicy = manager.AlignPolicyFunc(func(p string, size int64, head []byte) (int64, bool) {
+			e, ok := img.Lookup(p)
+			return e.Align, ok
+		})
+	}
+	if !l.isSet("elf") {
+		*l.elf = img.Footer.ELFPage > 0
+	}
+	if !l.isSet("compress") {
+		*l.compress = img.Footer.Compression
+	}
+	if !l.isSet("chunksize") && img.Footer.ChunkSize > 0 {
+		*l.chunkSize = img.Footer.ChunkSize
+	}
+	if !l.isSet("compressmeta") {
+		*l.metaCodec = img.Footer.SectionCodec
+	}
+	if !l.isSet("inline") {
+		*l.inline = img.Footer.InlineLimit
+	}
+	if !l.isSet("checksum") {
+		*l.checksum = false
+		for i := range img.Metadata {
+			if img.Metadata[i].Checksum != "" {
+				*l.checksum = true
+				break
+			}
+		}
+	}
+	if !l.isSet("dedup") {
+		*l.dedup = img.Footer.Dedup
+	}
+	if !l.isSet("fpprob") && img.Filter.FPProb > 0 {
+		*l.fpProb = img.Filter.FPProb
+	}
+	// Images written before child tables existed get the sorted order of the current format
+	if !l.isSet("keeporder") {
+		*l.keepOrder = img.Footer.FormatVersion() >= 5 && !img.Footer.SortedChildren
+	}
+}
+
+// keepsAlignment returns whether inherit keeps the alignment each file has in img:
+// img records it and no flag deciding the alignment is given
+func (l *layoutFlags) keepsAlignment(img *reader.Image) bool {
+	return img.Footer.FormatVersion() >= 10 && !l.isSet("policy") && !l.isSet("pagealign") && !l.isSet("align") && !l.isSet("packsmall")
+}
+
+// check returns an error if the flags don't describe a valid layout, and loads
+// the -policy rules
+func (l *layoutFlags) check() error {
+	if *l.policy != "" {
+		rules, err := policy.Load(*l.policy, writer.PageBoundary)
+		if err != nil {
+			return err
+		}
+		l.alignPolicy = rules
+	}
+	if *l.packSmall < 0 {
+		return fmt.Errorf("negative pack threshold %v", *l.packSmall)
+	}
+	for _, name := range []string{*l.compress, *l.metaCodec} {
+		if name == "" {
+			continue
+		}
+		if _, err := codec.Get(name); err != nil {
+			return err
+		}
+	}
+	if *l.chunkSize <= 0 {
+		return fmt.Errorf("chunk size %v is not positive", *l.chunkSize)
+	}
+	if *l.inline < 0 {
+		return fmt.Errorf("negative inline limit %v", *l.inline)
+	}
+	if !(*l.fpProb > 0 && *l.fpProb < 1) {
+		return fmt.Errorf("false positive probability %v is not between 0 and 1", *l.fpProb)
+	}
+	return manager.ValidAlignment(*l.align)
+}
+
+// alignment returns the boundary the data of files is aligned to. -align takes
+// precedence over -pagealign.
+func (l *layoutFlags) alignment() int64 {
+	if *l.align == 0 && *l.pageAlign {
+		return writer.PageBoundary
+	}
+	return *l.align
+}
+
+// elfPage returns the page size ELF files are placed for: the page size of the
+// host, or the alignment of the image if it is larger (e.g. huge pages)
+func (l *layoutFlags) elfPage() int64 {
+	if !*l.elf {
+		return 0
+	}
+	if a := l.alignment(); a > writer.PageBoundary {
+		return a
+	}
+	return writer.PageBoundary
+}
+
+// newManager creates a ZarManager with the layout given by the flags
+func (l *layoutFlags) newManager() *manager.ZarManager {
+	return &manager.ZarManager{
+		Alignment:     l.alignment(),
+		PackThreshold: *l.packSmall,
+		InlineLimit:   *l.inline,
+		Policy:        l.alignPolicy,
+		ELFPage:       l.elfPage(),
+		Compression:   *l.compress,
+		ChunkSize:     *l.chunkSize,
+		SectionCodec:  *l.metaCodec,
+		Checksum:      *l.checksum,
+		Dedup:         *l.dedup,
+		FPProb:        *l.fpProb,
+		KeepOrder:     *l.keepOrder,
+		Statistics:    &stats.ImgStats{},     // Initializes all fields to 0
+		Filter:        &filter.BloomFilter{}, // Default to BloomFilter
+	}
+}
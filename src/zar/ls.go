@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"fileio/reader"
+)
+
+// lsCmd lists the entries of an image like "ls -lR"
+//
+// usage: zar ls [-l] [-R] [-offsets] [-json] img [path]
+func lsCmd(args []string) int {
+	fs := newFlagSet("ls", "img [path]")
+	long := fs.Bool("l", false, "long listing: mode, size, mtime and link target")
+	recursive := fs.Bool("R", false, "list subdirectories recursively")
+	offsets := fs.Bool("offsets", false, "show begin and end offsets of file data")
+	jsonOut := fs.Bool("json", false, "output JSON")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		return 2
+	}
+
+	img, ok := openImage(fs.Arg(0))
+	if !ok {
+		return 1
+	}
+	defer img.Close()
+
+	listing, err := img.List(fs.Arg(1), *recursive)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "zar ls: %v\n", err)
+		return 1
+	}
+
+	if *jsonOut {
+		if err := writeJSON(listing.JSON(*offsets)); err != nil {
+			fmt.Fprintf(os.Stderr, "zar ls: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	if err := listing.Write(os.Stdout, reader.ListOptions{Long: *long, Offsets: *offsets}); err != nil {
+		fmt.Fprintf(os.Stderr, "zar ls: %v\n", err)
+		return 1
+	}
+	return 0
+}
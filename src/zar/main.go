@@ -15,7 +15,7 @@ import (
 	// TODO: Change paths to be remotely imported from github
 	"manager"
 	"filter"
-	"stats"
+	"fileio/reader"
 )
 
 // writeImage acts as the "main" method by creating and initializing the manager,
@@ -23,24 +23,13 @@ import (
 //
 // parameter (dir)	: the root dir name
 // parameter (output)	: the name of the image file
-// parameter (pageAlign): whether the files in the image will be page aligned
+// parameter (z)	: the manager, configured with the layout of the image
 // parameter (config)	: whether the image file is initialized from a config file
 // parameter (configPath): the path to the config file
 // parameter (format)	: the format of the config file
-func writeImage(dir string, output string, pageAlign bool, config bool, configPath string, format string) {
-	var z *manager.ZarManager
+func writeImage(dir string, output string, z *manager.ZarManager, config bool, configPath string, format string) {
 	var c *manager.CManager
 
-	// Initializes all fields to 0
-	var stats = &stats.ImgStats{}
-	var filter = &filter.BloomFilter{} // Default to BloomFilter
-
-	z = &manager.ZarManager{
-		PageAlign	: pageAlign,
-		Statistics	: stats,
-		Filter		: filter,
-	}
-
 	// Create the manager
 	// TODO: Make this not redundant code
 	if config {
@@ -111,6 +100,14 @@ func readImage(img string, detail bool) error {
 		fmt.Println("MMAP data:", mmap)
 	}
 
+	// Compressed sections are decoded by the reader, the steps below only know
+	// base64 encoded ones
+	if i, err := reader.Decode(mmap); err == nil && i.Footer.SectionCodec != "" {
+		fmt.Println("metadata and filter are compressed with", i.Footer.SectionCodec)
+		readFiles(mmap, i.Metadata, detail)
+		return nil
+	}
+
 	filtMetadata := processFilterHeader(mmap, length)
 
 	length = readFilter(mmap, filtMetadata)
@@ -155,12 +152,27 @@ func readFiles(mmap []byte, metadata []manager.FileMetadata, detail bool) {
 	level := 0
 	space := 2
 
+	// Images written before format version 6 mark the end of directories with ".."
+	// entries, newer ones nest the entries by their parent
+	markers := false
+	for i := range metadata {
+		markers = markers || metadata[i].IsDirEnd()
+	}
+	levels := make([]int, len(metadata))
+
 	// Print the structure (and data) of the image file
-	for _, v := range metadata {
+	for i, v := range metadata {
+		if !markers {
+			level = 0
+			if v.Parent >= 0 && v.Parent < i && metadata[v.Parent].Type == manager.Directory {
+				level = levels[v.Parent] + 1
+			}
+			levels[i] = level
+		}
 		for i := 0; i < space * level; i++ {
 			fmt.Printf(" ")
 		}
-		if v.Begin == -1 {
+		if v.Begin == -1 && v.Type != manager.RegularFile {
 			if v.Type == manager.Directory {
 				if v.Name != ".." {
 					fmt.Printf("[folder] %v\n", v.Name)
@@ -175,8 +187,14 @@ func readFiles(mmap []byte, metadata []manager.FileMetadata, detail bool) {
 		} else {
 			var fileString string
 			if detail {
-				fileBytes := mmap[v.Begin : v.End]
+				fileBytes := v.Inline
+				if !v.IsInline() {
+					fileBytes = mmap[v.Begin : v.End]
+				}
 				fileString = string(fileBytes)
+				if v.Codec != "" {
+					fileString = "compressed with " + v.Codec
+				}
 			} else {
 				fileString = "ignored"
 			}
@@ -254,6 +272,13 @@ func getHeaderLocation(mmap []byte, length int) (int64) {
 }
 
 func main() {
+	// Subcommands (e.g. "zar ls img") parse their own flags
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
+		}
+	}
+
 	// TODO: Add config file for version number
 	fmt.Println("zar image generator version 1")
 
@@ -264,7 +289,9 @@ func main() {
 	output := flag.String("o", "test.img", "output img name")
 	writeMode := flag.Bool("w", false, "generate image mode")
 	readMode := flag.Bool("r", false, "read image mode")
-	pageAlign := flag.Bool("pagealign", false, "align the page")
+	layout := addLayoutFlags(flag.CommandLine)
+	workers := flag.Int("workers", 1, "read, hash and compress `N` files of up to 1M in parallel, larger files are read when written; the image is the same for any N")
+	twoPass := flag.Bool("twopass", false, "plan the image first, then copy file data into place with copy_file_range, leaving padding as holes")
 	detailMode := flag.Bool("detail", false, "show original context when read")
 	config := flag.Bool("config", false, "img generated from config file")
 	configPath := flag.String("configPath", "", "path to config file for img")
@@ -273,8 +300,14 @@ func main() {
 
 	// TODO: Create a config struct for all flags
 	if *writeMode {
+		if err := layout.check(); err != nil {
+			log.Fatalf("invalid layout: %v", err)
+		}
 		fmt.Printf("root dir: %v\n", *dir)
-		writeImage(*dir, *output, *pageAlign, *config, *configPath, *configFormat)
+		z := layout.newManager()
+		z.Writer.Deferred = *twoPass
+		z.Workers = *workers
+		writeImage(*dir, *output, z, *config, *configPath, *configFormat)
 	}
 
 	if (*readMode) {
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"fileio/reader"
+)
+
+// mergeSource is an image and the prefix its tree is grafted at
+type mergeSource struct {
+	fn     string
+	prefix string
+}
+
+// mergeCmd combines several images into one, grafting the tree of each image at a
+// prefix. Data is copied straight from the source images. Paths present in more
+// than one image are conflicts; directories present in several images are merged.
+// Layout flags that are not given keep the layout of the first image.
+//
+// usage: zar merge -o out.img [-conflict error|first|last] a.img[:/prefix] ...
+func mergeCmd(args []string) int {
+	fs := newFlagSet("merge", "a.img[:/prefix] b.img[:/prefix] ...")
+	layout := addLayoutFlags(fs)
+	output := fs.String("o", "", "output img name")
+	conflict := fs.String("conflict", "error", "on conflicting paths: error (report and fail), first or last (the first or last image given wins)")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 || *output == "" {
+		fs.Usage()
+		return 2
+	}
+	if err := layout.check(); err != nil {
+		fmt.Fprintf(os.Stderr, "zar merge: %v\n", err)
+		return 2
+	}
+	if *conflict != "error" && *conflict != "first" && *conflict != "last" {
+		fmt.Fprintf(os.Stderr, "zar merge: unknown conflict policy %q\n", *conflict)
+		return 2
+	}
+
+	tree := reader.NewMergeTree()
+	var conflicts []string
+	for i, arg := range fs.Args() {
+		src := parseMergeSource(arg)
+		if sameFile(src.fn, *output) {
+			fmt.Fprintf(os.Stderr, "zar merge: source %v is the output image\n", src.fn)
+			return 2
+		}
+
+		img, ok := openImage(src.fn)
+		if !ok {
+			return 1
+		}
+		defer img.Close()
+
+		if i == 0 {
+			layout.inherit(img)
+			// Files keep the alignment of their own source image
+			if layout.keepsAlignment(img) {
+				layout.alignPolicy = tree.Alignments()
+			}
+		}
+		conflicts = append(conflicts, tree.Graft(img, src.fn, src.prefix, *conflict == "last")...)
+	}
+
+	for _, c := range conflicts {
+		fmt.Fprintf(os.Stderr, "zar merge: conflict: %v\n", c)
+	}
+	if len(conflicts) > 0 && *conflict == "error" {
+		fmt.Fprintf(os.Stderr, "zar merge: %v conflicts, use -conflict first|last to resolve them by precedence\n", len(conflicts))
+		return 1
+	}
+
+	z := layout.newManager()
+	z.Writer.Init(*output)
+	if err := tree.Write(z); err != nil {
+		fmt.Fprintf(os.Stderr, "zar merge: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// parseMergeSource splits "a.img:/prefix" into the image and the prefix ("/" if none)
+func parseMergeSource(arg string) mergeSource {
+	if i := strings.LastIndex(arg, ":/"); i > 0 {
+		return mergeSource{fn: arg[:i], prefix: reader.Clean(arg[i+1:])}
+	}
+	return mergeSource{fn: arg, prefix: "/"}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"fileio/reader"
+)
+
+// repackCmd rewrites an image with a new layout. All data is read from the source
+// image, the directory it was built from is not needed. Layout flags that are not
+// given keep the layout of the source image.
+//
+// usage: zar repack [flags] src.img dst.img
+func repackCmd(args []string) int {
+	fs := newFlagSet("repack", "src.img dst.img")
+	layout := addLayoutFlags(fs)
+	order := fs.String("order", "dfs", "order of the file data: dfs, offset, path or size")
+	orderFile := fs.String("orderfile", "", "file with one image path per line whose data is written first, in that order")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+	if err := layout.check(); err != nil {
+		fmt.Fprintf(os.Stderr, "zar repack: %v\n", err)
+		return 2
+	}
+	if _, ok := reader.DataOrders[*order]; !ok {
+		fmt.Fprintf(os.Stderr, "zar repack: unknown order %q\n", *order)
+		return 2
+	}
+	if sameFile(fs.Arg(0), fs.Arg(1)) {
+		fmt.Fprintf(os.Stderr, "zar repack: source and destination are the same file\n")
+		return 2
+	}
+
+	src, ok := openImage(fs.Arg(0))
+	if !ok {
+		return 1
+	}
+	defer src.Close()
+
+	opts := reader.RepackOptions{Order: *order}
+	if *orderFile != "" {
+		first, err := readPathList(*orderFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "zar repack: %v\n", err)
+			return 1
+		}
+		opts.First = first
+	}
+
+	layout.inherit(src)
+	z := layout.newManager()
+	z.Writer.Init(fs.Arg(1))
+
+	if err := src.Repack(z, opts); err != nil {
+		fmt.Fprintf(os.Stderr, "zar repack: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// readPathList returns the non-empty lines of the file fn, e.g. the image paths
+// of an order file
+func readPathList(fn string) ([]string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var paths []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if p := strings.TrimSpace(scanner.Text()); p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths, scanner.Err()
+}
+
+// sameFile returns whether the paths a and b name the same existing file
+func sameFile(a string, b string) bool {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	fb, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fa, fb)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"server"
+)
+
+// serveCmd serves the files of an image read-only over HTTP
+//
+// usage: zar serve [-addr :8080] img
+func serveCmd(args []string) int {
+	fs := newFlagSet("serve", "img")
+	addr := fs.String("addr", ":8080", "address to listen on")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	img, ok := openImage(fs.Arg(0))
+	if !ok {
+		return 1
+	}
+	defer img.Close()
+
+	fmt.Printf("serving %v on %v\n", fs.Arg(0), *addr)
+	if err := http.ListenAndServe(*addr, server.NewHandler(img)); err != nil {
+		fmt.Fprintf(os.Stderr, "zar serve: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"server"
+)
+
+// serve9pCmd serves the files of an image read-only over 9P2000.L on a unix socket,
+// e.g. for gVisor gofers or mount -t 9p -o trans=unix,version=9p2000.L
+//
+// usage: zar serve-9p -socket /tmp/zar.sock img
+func serve9pCmd(args []string) int {
+	fs := newFlagSet("serve-9p", "img")
+	socket := fs.String("socket", "", "path of the unix socket to listen on")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 || *socket == "" {
+		fs.Usage()
+		return 2
+	}
+
+	img, ok := openImage(fs.Arg(0))
+	if !ok {
+		return 1
+	}
+	defer img.Close()
+
+	// A socket left behind by a previous server would make Listen fail
+	if fi, err := os.Lstat(*socket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(*socket)
+	}
+
+	l, err := net.Listen("unix", *socket)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "zar serve-9p: %v\n", err)
+		return 1
+	}
+	defer l.Close()
+
+	fmt.Printf("serving %v on %v\n", fs.Arg(0), *socket)
+	if err := server.NewP9Server(img).Serve(l); err != nil {
+		fmt.Fprintf(os.Stderr, "zar serve-9p: %v\n", err)
+		return 1
+	}
+	return 0
+}
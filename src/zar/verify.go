@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// verifyCmd checks the structural consistency of an image. It prints every
+// problem found and exits non-zero if there is any.
+//
+// usage: zar verify [-q] img
+func verifyCmd(args []string) int {
+	fs := newFlagSet("verify", "img")
+	quiet := fs.Bool("q", false, "only report problems")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	img, ok := openImage(fs.Arg(0))
+	if !ok {
+		return 1
+	}
+	defer img.Close()
+
+	problems := img.Verify()
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+
+	if len(problems) > 0 {
+		fmt.Fprintf(os.Stderr, "zar verify: %v: %v problems found\n", fs.Arg(0), len(problems))
+		return 1
+	}
+	if !*quiet {
+		fmt.Printf("%v: ok, %v entries checked\n", fs.Arg(0), len(img.Metadata))
+	}
+	return 0
+}